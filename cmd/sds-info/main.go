@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/fjl/sds/sds"
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("need .sds file as argument")
+	}
+	fd, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+
+	r := sds.NewSampleReader(sds.NewDecoder(fd))
+	h, err := r.Header()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var (
+		samples []int
+		packets int
+	)
+	for {
+		block, err := r.ReadSamples()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			log.Printf("warning: file is truncated, has %d of %d packets", packets, sds.ExpectedPackets(h))
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		samples = append(samples, block...)
+		packets++
+	}
+	printHeader(h)
+	printStats(sds.ComputeStats(samples, int(h.BitDepth)), int(h.BitDepth))
+}
+
+func printHeader(h *sds.DumpHeader) {
+	fmt.Printf("channel:     %d\n", h.Channel)
+	fmt.Printf("waveform:    %d\n", h.Number)
+	fmt.Printf("bit depth:   %d\n", h.BitDepth)
+	fmt.Printf("period:      %dns (%s)\n", h.Period, sds.FormatSampleRate(h.Period))
+	if h.SampleRate > 0 {
+		fmt.Printf("sample rate: %g Hz (extended header)\n", h.SampleRate)
+	}
+	fmt.Printf("length:      %d samples (%v)\n", h.Length, h.Duration())
+	fmt.Printf("loop:        %d-%d, type %#x\n", h.LoopStart, h.LoopEnd, h.LoopType)
+}
+
+func printStats(st sds.Stats, bitDepth int) {
+	fullScale := float64(sds.ZeroPoint(bitDepth))
+	fmt.Printf("range:       %d..%d\n", st.Min, st.Max)
+	fmt.Printf("DC offset:   %.2f (%.3f%% of full scale)\n", st.Mean, st.Mean/fullScale*100)
+	fmt.Printf("full scale:  %d positive, %d negative\n", st.FullScalePos, st.FullScaleNeg)
+}
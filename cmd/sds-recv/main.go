@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/fjl/sds/internal/cmdutil"
+	"github.com/fjl/sds/sds"
+)
+
+func main() {
+	// Argument processing.
+	var (
+		inDevice  = flag.String("dev", "", "MIDI input device (name:chN also sets -ch)")
+		outDevice = flag.String("odev", "", "MIDI output device (default: same as input)")
+		exact     = flag.Bool("exact", false, "Require exact match of the input device name")
+		channel   = flag.Int("ch", 0, "Sysex channel number")
+		slot      = cmdutil.SlotFlag("slot", 0, "Waveform slot number (decimal or 0x-prefixed hex)")
+		slotBase  = flag.Int("slot-base", 0, "Number of the first slot on the device (0 or 1)")
+		request   = flag.Bool("request", false, "Request the waveform from the device")
+		anyCh     = flag.Bool("channel-any", false, "Accept a dump on any sysex channel and lock onto it")
+		wavBits   = flag.Int("wav-bits", 0, "Bit depth of output file (default: nearest standard depth)")
+		name      = flag.String("name", "", "Name stored in the INFO chunk of the output file")
+		loops     = flag.Bool("loops", false, "Receive additional loops (SDS extension) after the dump")
+		noEOX     = flag.Bool("unterminated", false, "Accept sysex messages without the final F7 (for drivers that strip it)")
+	)
+	flag.Parse()
+	device, err := cmdutil.ParseDevice(*inDevice, channel)
+	if err != nil {
+		log.Fatal("-dev: ", err)
+	}
+	if err := cmdutil.ValidateChannel(*channel); err != nil {
+		log.Fatal("-ch: ", err)
+	}
+	number, err := cmdutil.WaveformNumber(*slot, *slotBase)
+	if err != nil {
+		log.Fatal("-slot: ", err)
+	}
+	switch *wavBits {
+	case 0, 8, 16, 24, 32:
+	default:
+		log.Fatalf("-wav-bits: unsupported WAV bit depth %d", *wavBits)
+	}
+	midiConfig := cmdutil.Config{InDevice: device, OutDevice: *outDevice, ExactMatch: *exact, UniversalOnly: true, Unterminated: *noEOX}
+	recvConfig := sds.TransferConfig{
+		Channel:    byte(*channel),
+		Request:    *request,
+		AnyChannel: *anyCh,
+		Number:     uint16(number),
+		Log:        log.Printf,
+	}
+	if flag.NArg() != 1 {
+		log.Fatal("need output file as argument")
+	}
+	filename := flag.Arg(0)
+
+	// Receive the waveform.
+	conn, err := cmdutil.Open(&midiConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	header, samples, err := sds.ReceiveDump(ctx, conn, &recvConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	meta := &sds.WAVMetadata{Name: *name}
+	if *loops {
+		if meta.Loops, err = sds.ReceiveLoops(ctx, conn, header, *request); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("received %d loops", len(meta.Loops))
+	}
+
+	// Write it to the file.
+	bits := *wavBits
+	if bits == 0 {
+		bits = standardBitDepth(int(header.BitDepth))
+	}
+	if err := writeWAV(filename, header, samples, bits, meta); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s (%d bits)", filename, bits)
+}
+
+// standardBitDepth returns the smallest standard WAV bit depth that can hold
+// samples of the given depth.
+func standardBitDepth(bits int) int {
+	switch {
+	case bits <= 8:
+		return 8
+	case bits <= 16:
+		return 16
+	case bits <= 24:
+		return 24
+	default:
+		return 32
+	}
+}
+
+func writeWAV(file string, h *sds.DumpHeader, samples []int, bits int, meta *sds.WAVMetadata) error {
+	fd, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if err := sds.WriteSDSToWAV(fd, h, samples, bits, meta); err != nil {
+		return err
+	}
+	return fd.Close()
+}
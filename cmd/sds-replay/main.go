@@ -0,0 +1,126 @@
+// Command sds-replay transmits the messages of a captured .sds or .syx file to a
+// MIDI device. Unlike sds-send, the messages are sent as stored in the file, so
+// archived dumps can be restored without conversion.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fjl/sds/internal/cmdutil"
+	"github.com/fjl/sds/sds"
+)
+
+func main() {
+	// Argument processing.
+	var (
+		inDevice  = flag.String("dev", "", "MIDI input device")
+		outDevice = flag.String("odev", "", "MIDI output device (default: same as input)")
+		exact     = flag.Bool("exact", false, "Require exact match of the input device name")
+		maxSysex  = flag.Int("max-sysex", 0, "Split sysex messages into chunks of this size (0 = no limit)")
+		retries   = flag.Int("header-retries", 0, "Resend header this many times if receiver does not respond")
+		delay     = flag.Duration("delay", 20*time.Millisecond, "Delay between messages when receiver is non-handshaking")
+		ackTime   = flag.Duration("ack-timeout", 20*time.Millisecond, "Time to wait for the acknowledgement of a packet when handshaking")
+		timeout   = flag.Duration("timeout", 0, "Abort the replay after this time (0 = no limit)")
+		force     = flag.Bool("force", false, "Send packets with bad checksums instead of failing")
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("need .sds or .syx file as argument")
+	}
+	fd, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+
+	midiConfig := cmdutil.Config{
+		InDevice:      *inDevice,
+		OutDevice:     *outDevice,
+		ExactMatch:    *exact,
+		UniversalOnly: true,
+		MaxWriteSize:  *maxSysex,
+	}
+	cfg := sds.TransferConfig{
+		HeaderRetries: *retries,
+		PacketDelay:   *delay,
+		AckTimeout:    *ackTime,
+		Log:           log.Printf,
+	}
+	conn, err := cmdutil.Open(&midiConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dec := sds.NewDecoder(fd)
+	dec.TolerateChecksumErrors = *force
+	dec.HighBitPolicy = sds.HighBitError
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	n, err := replay(ctx, &cfg, conn, dec)
+	if err != nil {
+		log.Fatalf("message %d: %v", n, err)
+	}
+	log.Printf("sent %d messages", n)
+}
+
+// replay transmits all messages read from dec. Each dump, i.e. a DumpHeader and the
+// data packets following it, is sent by sds.SendOp.Run with the stored packets, so
+// it gets the same handshaking as a transfer by sds-send. Other messages are sent
+// as they are, with cfg.PacketDelay between them. replay returns the number of
+// messages sent.
+func replay(ctx context.Context, cfg *sds.TransferConfig, t sds.Transport, dec *sds.Decoder) (int, error) {
+	var msgs []sds.Message
+	for {
+		msg, err := dec.ReadMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return len(msgs), err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		switch msg := msgs[sent].(type) {
+		case *sds.DumpHeader:
+			var packets []*sds.DataPacket
+			for _, m := range msgs[sent+1:] {
+				p, ok := m.(*sds.DataPacket)
+				if !ok {
+					break
+				}
+				packets = append(packets, p)
+			}
+			op, err := sds.NewPacketSendOp(msg, packets)
+			if err != nil {
+				return sent, err
+			}
+			log.Printf(">> DumpHeader: waveform %d, %d bits, %d samples", msg.Number, msg.BitDepth, msg.Length)
+			if err := op.Run(ctx, t, cfg); err != nil {
+				return sent, err
+			}
+			sent += 1 + len(packets)
+		case *sds.DataPacket:
+			return sent, errors.New("data packet without DumpHeader")
+		default:
+			if err := t.Send(msg); err != nil {
+				return sent, err
+			}
+			time.Sleep(cfg.PacketDelay)
+			sent++
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/internal/sdstest"
+	"github.com/fjl/sds/sds"
+)
+
+type mockReceiver = sdstest.Receiver[sds.Message]
+
+var newMockReceiver = sdstest.NewReceiver[sds.Message]
+
+// encoded returns the concatenated encoding of all messages sent to r.
+func encoded(r *mockReceiver) []byte {
+	var b []byte
+	for _, msg := range r.Received() {
+		b = msg.Encode(b)
+	}
+	return b
+}
+
+// handshake acknowledges the header and all packets.
+func handshake(r *mockReceiver, msg sds.Message) {
+	switch msg := msg.(type) {
+	case *sds.DumpHeader:
+		r.Respond(sds.NewAck(msg.Channel, 0), 0)
+	case *sds.DataPacket:
+		r.Respond(sds.NewAck(msg.Channel, msg.PacketNumber), 0)
+	}
+}
+
+func loadDump(t *testing.T) []byte {
+	raw, err := os.ReadFile("../../sds/testdata/akwf1_16bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestReplayHandshake(t *testing.T) {
+	raw := loadDump(t)
+	r := newMockReceiver(handshake)
+	n, err := replay(context.Background(), new(sds.TransferConfig), r, sds.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Errorf("sent %d messages, want 16", n)
+	}
+	if !bytes.Equal(encoded(r), raw) {
+		t.Error("sent messages differ from file")
+	}
+}
+
+func TestReplayNonHandshaking(t *testing.T) {
+	raw := loadDump(t)
+	r := newMockReceiver(func(*mockReceiver, sds.Message) {})
+	cfg := &sds.TransferConfig{HandshakeTimeout: 20 * time.Millisecond, PacketDelay: time.Millisecond}
+	start := time.Now()
+	if _, err := replay(context.Background(), cfg, r, sds.NewDecoder(bytes.NewReader(raw))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < cfg.HandshakeTimeout {
+		t.Errorf("packets sent after %v, before the header timeout", d)
+	}
+	if !bytes.Equal(encoded(r), raw) {
+		t.Error("sent messages differ from file")
+	}
+}
+
+func TestReplayNak(t *testing.T) {
+	raw := loadDump(t)
+	var nakked bool
+	r := newMockReceiver(func(r *mockReceiver, msg sds.Message) {
+		if p, ok := msg.(*sds.DataPacket); ok && p.PacketNumber == 2 && !nakked {
+			nakked = true
+			r.Respond(sds.NewNak(p.Channel, 2), 0)
+			return
+		}
+		handshake(r, msg)
+	})
+	if _, err := replay(context.Background(), new(sds.TransferConfig), r, sds.NewDecoder(bytes.NewReader(raw))); err != nil {
+		t.Fatal(err)
+	}
+	got := r.Received()
+	if len(got) != 17 {
+		t.Fatalf("receiver got %d messages, want 17", len(got))
+	}
+	if got[3].(*sds.DataPacket).PacketNumber != 2 || got[4].(*sds.DataPacket).PacketNumber != 2 {
+		t.Error("rejected packet not resent")
+	}
+}
+
+// This checks that -force sends packets with bad checksums unchanged.
+func TestReplayBadChecksum(t *testing.T) {
+	raw := loadDump(t)
+	raw[len(raw)-10] ^= 0x01 // corrupt the last packet
+	r := newMockReceiver(handshake)
+
+	if _, err := replay(context.Background(), new(sds.TransferConfig), r, sds.NewDecoder(bytes.NewReader(raw))); err == nil {
+		t.Fatal("no error for bad checksum")
+	}
+	r = newMockReceiver(handshake)
+	dec := sds.NewDecoder(bytes.NewReader(raw))
+	dec.TolerateChecksumErrors = true
+	if _, err := replay(context.Background(), new(sds.TransferConfig), r, dec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded(r), raw) {
+		t.Error("sent messages differ from file")
+	}
+}
+
+// This checks that replay gives up when the context is done, e.g. on -timeout.
+func TestReplayTimeout(t *testing.T) {
+	raw := loadDump(t)
+	// The receiver keeps the sender waiting forever.
+	r := newMockReceiver(func(r *mockReceiver, msg sds.Message) {
+		if h, ok := msg.(*sds.DumpHeader); ok {
+			r.Respond(sds.NewWait(h.Channel, 0), 0)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := replay(ctx, new(sds.TransferConfig), r, sds.NewDecoder(bytes.NewReader(raw)))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want deadline error", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fjl/sds/internal/cmdutil"
+	"github.com/fjl/sds/sds"
+)
+
+func main() {
+	// Argument processing.
+	var (
+		inDevice  = flag.String("dev", "", "MIDI input device (name:chN also sets -ch)")
+		outDevice = flag.String("odev", "", "MIDI output device (default: same as input)")
+		exact     = flag.Bool("exact", false, "Require exact match of the input device name")
+		channel   = flag.Int("ch", 0, "Sysex channel number")
+		from      = cmdutil.SlotFlag("from", 0, "First waveform slot number")
+		to        = cmdutil.SlotFlag("to", 127, "Last waveform slot number")
+		timeout   = flag.Duration("timeout", 500*time.Millisecond, "Time to wait for each slot")
+	)
+	flag.Parse()
+	device, err := cmdutil.ParseDevice(*inDevice, channel)
+	if err != nil {
+		log.Fatal("-dev: ", err)
+	}
+	if err := cmdutil.ValidateChannel(*channel); err != nil {
+		log.Fatal("-ch: ", err)
+	}
+	if err := cmdutil.ValidateWaveformNumber(*from); err != nil {
+		log.Fatal("-from: ", err)
+	}
+	if err := cmdutil.ValidateWaveformNumber(*to); err != nil {
+		log.Fatal("-to: ", err)
+	}
+	midiConfig := cmdutil.Config{InDevice: device, OutDevice: *outDevice, ExactMatch: *exact, UniversalOnly: true}
+	scanConfig := scanConfig{Channel: byte(*channel), From: *from, To: *to, Timeout: *timeout}
+
+	conn, err := cmdutil.Open(&midiConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	found := scan(&scanConfig, conn)
+	for _, h := range found {
+		fmt.Printf("slot %d: %d bits, %s, %d samples\n", h.Number, h.BitDepth, sds.FormatSampleRate(h.Period), h.Length)
+	}
+	log.Printf("found %d populated slots", len(found))
+}
+
+type scanConfig struct {
+	Channel  byte
+	From, To int
+	Timeout  time.Duration
+}
+
+// scan requests a dump of every slot in the configured range. It returns the
+// headers of all slots that responded with a DumpHeader.
+func scan(cfg *scanConfig, conn *cmdutil.Conn) []*sds.DumpHeader {
+	var found []*sds.DumpHeader
+	for n := cfg.From; n <= cfg.To; n++ {
+		if h := requestHeader(cfg, conn, uint16(n)); h != nil {
+			found = append(found, h)
+		}
+	}
+	return found
+}
+
+// requestHeader sends a DumpRequest and waits for the DumpHeader. When the header
+// arrives, the dump is cancelled.
+func requestHeader(cfg *scanConfig, conn *cmdutil.Conn, number uint16) *sds.DumpHeader {
+	err := conn.Send(&sds.DumpRequest{Channel: cfg.Channel, Number: number})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		switch msg := conn.ReceiveTimeout(cfg.Timeout).(type) {
+		case nil:
+			return nil
+		case *sds.DumpHeader:
+			if msg.Channel != cfg.Channel || msg.Number != number {
+				continue
+			}
+			if err := conn.Send(sds.NewCancel(cfg.Channel, 0)); err != nil {
+				log.Fatal(err)
+			}
+			drain(conn)
+			return msg
+		case *sds.ControlPacket:
+			if msg.Channel != cfg.Channel {
+				continue
+			}
+			if msg.Type == sds.Nak || msg.Type == sds.Cancel {
+				return nil
+			}
+		}
+	}
+}
+
+// drain discards messages until the device goes quiet.
+func drain(conn *cmdutil.Conn) {
+	for conn.ReceiveTimeout(100*time.Millisecond) != nil {
+	}
+}
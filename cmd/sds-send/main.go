@@ -1,9 +1,30 @@
+// Command sds-send transmits a WAV file to a sampler using the MIDI Sample Dump
+// Standard.
+//
+// The exit status is 0 when the transfer succeeded. Otherwise it is one of:
+//
+//	1  other error
+//	2  invalid arguments
+//	3  the input file can't be read or doesn't fit into a dump
+//	4  the MIDI device can't be found or opened
+//	5  the receiver denied the transfer (NAK or CANCEL)
+//	6  the receiver stopped responding, or -timeout was exceeded
+//	7  -confirm was given, but the receiver did not acknowledge the transfer
+//	8  -verify found a difference
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fjl/sds/internal/cmdutil"
@@ -16,52 +37,488 @@ import (
 func main() {
 	// Argument processing.
 	var (
-		inDevice  = flag.String("dev", "", "MIDI input device")
+		inDevice  = flag.String("dev", "", "MIDI input device (name:chN also sets -ch), or comma-separated list of devices to send to in parallel")
 		outDevice = flag.String("odev", "", "MIDI output device (default: same as input)")
-		channel   = flag.Int("ch", 0, "Sysex channel number")
-		slot      = flag.Int("slot", 0, "Waveform slot number")
+		exact     = flag.Bool("exact", false, "Require exact match of the input device name")
+		channel   = flag.Int("ch", 0, "Sysex channel number (127 sends to all channels)")
+		slot      = cmdutil.SlotFlag("slot", 0, "Waveform slot number (decimal or 0x-prefixed hex)")
+		slotBase  = flag.Int("slot-base", 0, "Number of the first slot on the device (0 or 1)")
+		nameSlot  = flag.Bool("number-from-name", false, "Take the slot number from the leading digits of the file name (default: -slot)")
+		probe     = flag.Bool("probe", false, "Detect whether receiver supports handshaking before sending")
+		maxSysex  = flag.Int("max-sysex", 0, "Split sysex messages into chunks of this size (0 = no limit)")
+		retries   = flag.Int("header-retries", 0, "Resend header this many times if receiver does not respond")
+		nakRetry  = flag.Int("nak-retries", 3, "Resend a rejected packet this many times before cancelling")
+		confirm   = flag.Bool("confirm", false, "Wait for the receiver to acknowledge the last packet")
+		split     = flag.Bool("split", false, "Split long waveforms across consecutive slots")
+		resume    = flag.Int("resume-from", 0, "Resume interrupted transfer at this packet (header is not sent)")
+		verify    = flag.Bool("verify", false, "Read back the waveform after sending and compare it")
+		serve     = flag.Bool("serve", false, "Wait for a DumpRequest for the slot instead of sending immediately")
+		loopLen   = flag.Int("loop-length", 0, "Resample the loop (or the whole waveform if it has none) to this many samples")
+		relStart  = flag.Int("release-loop-start", 0, "Start of the release loop")
+		relEnd    = flag.Int("release-loop-end", 0, "End of the release loop (0 = no release loop)")
+		timeout   = flag.Duration("timeout", 0, "Abort the transfer after this time (0 = no limit)")
+		preSysex  = flag.String("pre-sysex", "", "Sysex message (hex, or gm-reset) to send before the dump")
+		notesOff  = flag.Bool("all-notes-off", false, "Send All Notes Off on all MIDI channels before the dump")
+		crossfade = flag.Duration("loop-crossfade", 0, "Crossfade the end of the loop into its start over this duration")
+		bits      = flag.String("bits", "auto", "Sample bit depth (8-28), or auto to use the depth of the input file")
+		probeBits = flag.Bool("probe-bits", false, "With -bits auto, fall back to a lower bit depth if the receiver rejects it")
+		firstDly  = flag.Duration("first-packet-delay", 0, "Pause between header ACK and first data packet")
+		timing    = flag.Bool("log-timing", false, "Log the time between received messages")
+		delay     = flag.Duration("packet-delay", 20*time.Millisecond, "Delay between packets when receiver is non-handshaking")
+		pad       = flag.String("pad", "", "Pad the waveform to a multiple of the packet size (packet) or a power of two (pow2)")
+		padRepeat = flag.Bool("pad-repeat", false, "Pad by extending the loop instead of appending zero samples")
+		hdrOnly   = flag.Bool("header-only", false, "Send only the DumpHeader and print the responses of the receiver")
+		progress  = flag.String("progress", "log", "Progress display: bar (on a terminal), log or none")
+		reverse   = flag.Bool("reverse", false, "Reverse the waveform before sending (the loop is moved to cover the same samples)")
+		loopOnly  = flag.Bool("loop-only", false, "Don't send a waveform, only set the loop of the slot to -loop-start/-loop-end")
+		loopStart = flag.Int("loop-start", 0, "Start of the loop set by -loop-only")
+		loopEnd   = flag.Int("loop-end", 0, "End of the loop set by -loop-only")
+		loopType  = flag.String("loop-type", "forward", "Type of the loop set by -loop-only: forward or pingpong")
+		noEOX     = flag.Bool("unterminated", false, "Accept sysex messages without the final F7 (for drivers that strip it)")
 	)
 	flag.Parse()
-	midiConfig := cmdutil.Config{InDevice: *inDevice, OutDevice: *outDevice}
-	sendConfig := sendConfig{Channel: *channel, WaveformNumber: *slot}
+	if err := cmdutil.ValidateChannel(*channel); err != nil {
+		exit(exitUsage, "-ch: ", err)
+	}
+	lf := loopFlags{
+		loopOnly: *loopOnly,
+		start:    *loopStart,
+		end:      *loopEnd,
+		typ:      *loopType,
+		nameSlot: *nameSlot,
+		hdrOnly:  *hdrOnly,
+		serve:    *serve,
+		verify:   *verify,
+		resume:   *resume,
+	}
+	if err := lf.check(); err != nil {
+		exit(exitUsage, err)
+	}
+	if *nameSlot {
+		if n, ok := cmdutil.SlotFromName(flag.Arg(0)); ok {
+			*slot = n
+		} else {
+			log.Printf("no number in file name, using slot %d", *slot)
+		}
+	}
+	number, err := cmdutil.WaveformNumber(*slot, *slotBase)
+	if err != nil {
+		exit(exitUsage, "-slot: ", err)
+	}
+	if *relEnd < 0 || *relStart < 0 || (*relEnd > 0 && *relStart > *relEnd) {
+		exit(exitUsage, "-release-loop-start/-release-loop-end: invalid loop")
+	}
+	var preMsg []byte
+	if *preSysex != "" {
+		if preMsg, err = cmdutil.ParseSysex(*preSysex); err != nil {
+			exit(exitUsage, "-pre-sysex: ", err)
+		}
+	}
+	if *pad != "" && *pad != "packet" && *pad != "pow2" {
+		exit(exitUsage, "-pad: invalid mode ", *pad, ", must be packet or pow2")
+	}
+	if *nakRetry < 0 {
+		exit(exitUsage, "-nak-retries: must not be negative")
+	}
+	switch *progress {
+	case "bar":
+		if !isTerminal(os.Stderr) {
+			*progress = "log"
+		}
+	case "log", "none":
+	default:
+		exit(exitUsage, "-progress: invalid mode ", *progress, ", must be bar, log or none")
+	}
+	if *probeBits && *bits != "auto" {
+		exit(exitUsage, "-probe-bits requires -bits auto")
+	}
+	if *hdrOnly && (*serve || *verify || *resume > 0) {
+		exit(exitUsage, "-header-only can't be used with -serve, -verify or -resume-from")
+	}
+	if *serve && *probe {
+		exit(exitUsage, "-probe can't be used with -serve")
+	}
+	devices := strings.Split(*inDevice, ",")
+	if len(devices) > 1 && *outDevice != "" {
+		exit(exitUsage, "-odev can't be used with multiple devices")
+	}
+	if len(devices) > 1 && *progress == "bar" {
+		*progress = "log" // bars of concurrent transfers would overwrite each other
+	}
+	midiConfig := cmdutil.Config{
+		OutDevice:     *outDevice,
+		ExactMatch:    *exact,
+		UniversalOnly: true,
+		MaxWriteSize:  *maxSysex,
+		Timing:        *timing,
+		Unterminated:  *noEOX,
+	}
+	sendConfig := sendConfig{
+		TransferConfig: sds.TransferConfig{
+			Channel:          byte(*channel),
+			Number:           uint16(number),
+			Probe:            *probe,
+			HeaderRetries:    *retries,
+			NakRetries:       nakRetries(*nakRetry),
+			Confirm:          *confirm,
+			ResumeFrom:       *resume,
+			PacketDelay:      *delay,
+			FirstPacketDelay: *firstDly,
+			Log:              log.Printf,
+		},
+		Verify:   *verify,
+		Serve:    *serve,
+		Progress: *progress,
+	}
+	if *relEnd > 0 {
+		sendConfig.ReleaseLoop = &sds.LoopPoint{Loop: 1, Type: sds.LoopForward, Start: uint(*relStart), End: uint(*relEnd)}
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if *loopOnly {
+		if flag.NArg() != 0 {
+			exit(exitUsage, "-loop-only doesn't take a wave file")
+		}
+		targets := openTargets(devices, *channel, midiConfig, *notesOff, preMsg)
+		code := 0
+		for _, t := range targets {
+			lp := &sds.LoopPoint{Channel: t.channel, Number: uint16(number), Type: loopTypes[*loopType], Start: uint(*loopStart), End: uint(*loopEnd)}
+			cfg := sendConfig.TransferConfig
+			cfg.Log = t.logf
+			if c := sendLoopOnly(ctx, t.conn, &cfg, lp); code == 0 {
+				code = c
+			}
+		}
+		for _, t := range targets {
+			t.conn.Close()
+		}
+		os.Exit(code)
+	}
 	if flag.NArg() != 1 {
-		log.Fatal("need wave file as argument")
+		exit(exitUsage, "need wave file as argument")
 	}
 	filename := flag.Arg(0)
 
-	// Load .wav file.
-	buffer, err := readWAV(filename)
+	// Load .wav file. The loop stored in the file takes precedence: -loop-length
+	// resamples it and -pad keeps it. They create a loop only when the file has none.
+	buffer, loop, err := readWAV(filename)
 	if err != nil {
-		log.Fatal(err)
+		exit(exitFile, err)
 	}
 
+	if len(buffer.Data) == 0 {
+		exit(exitFile, filename, ": ", sds.ErrEmptyWaveform)
+	}
 	if buffer.Format.NumChannels > 1 {
 		log.Println("converting to mono")
 		buffer = mixToMono(buffer)
 	}
 
-	// Send the waveform data.
-	conn, err := cmdutil.Open(&midiConfig)
+	// Open the devices.
+	targets := openTargets(devices, *channel, midiConfig, *notesOff, preMsg)
+	for _, t := range targets {
+		defer t.conn.Close()
+	}
+
+	depth, err := targetBitDepth(*bits, buffer.SourceBitDepth)
 	if err != nil {
-		log.Fatal(err)
+		exit(exitUsage, "-bits: ", err)
+	}
+	if *probeBits {
+		// With multiple devices, use the highest depth accepted by all of them.
+		header := sds.HeaderFromIntBuffer(buffer, sendConfig.Channel, sendConfig.Number)
+		max := depth
+		for _, t := range targets {
+			h := header.Clone()
+			h.Channel = t.channel
+			if d := probeBitDepth(ctx, t, h, max); d < depth {
+				depth = d
+			}
+		}
+	}
+	if depth != buffer.SourceBitDepth {
+		log.Printf("converting from %d to %d bits", buffer.SourceBitDepth, depth)
+		sds.ConvertBitDepth(buffer.Data, buffer.SourceBitDepth, depth)
+		buffer.SourceBitDepth = depth
+	}
+	if *loopLen > 0 {
+		if loop, err = fitLoop(buffer, loop, *loopLen); err != nil {
+			exit(exitFile, "-loop-length: ", err)
+		}
+		log.Printf("resampled loop to %d samples", *loopLen)
+	}
+	if *crossfade > 0 {
+		if loop == nil {
+			exit(exitUsage, "-loop-crossfade: waveform has no loop")
+		}
+		want := int(crossfade.Seconds() * float64(buffer.Format.SampleRate))
+		n, err := sds.CrossfadeLoop(buffer.Data, int(loop.Start), int(loop.End), want)
+		if err != nil {
+			exit(exitFile, "-loop-crossfade: ", err)
+		}
+		if n < want {
+			log.Printf("warning: crossfade shortened to %d samples, the loop or the samples before it are shorter than %d", n, want)
+		}
+		log.Printf("crossfaded %d samples at loop end", n)
+	}
+	if *reverse {
+		if loop != nil {
+			if int(loop.End) >= len(buffer.Data) || loop.Start > loop.End {
+				exit(exitFile, fmt.Sprintf("-reverse: loop %d-%d is outside of waveform", loop.Start, loop.End))
+			}
+			start, end := sds.ReverseWaveform(buffer.Data, int(loop.Start), int(loop.End))
+			reversed := *loop
+			reversed.Start, reversed.End = uint32(start), uint32(end)
+			loop = &reversed
+			log.Printf("reversed waveform, loop moved to %d-%d", start, end)
+		} else {
+			sds.ReverseWaveform(buffer.Data, 0, 0)
+			log.Println("reversed waveform")
+		}
+	}
+	if *pad != "" {
+		orig := len(buffer.Data)
+		if loop, err = padWaveform(buffer, loop, *pad, *padRepeat); err != nil {
+			exit(exitFile, "-pad: ", err)
+		}
+		log.Printf("padded waveform from %d to %d samples", orig, len(buffer.Data))
+	}
+
+	parts := sds.SplitWaveform(buffer.Data)
+	if len(parts) > 1 {
+		if !*split {
+			exit(exitFile, fmt.Sprintf("waveform has %d samples, max. is %d (use -split to send it to multiple slots)", len(buffer.Data), sds.MaxLength))
+		}
+		if err := cmdutil.ValidateWaveformNumber(number + len(parts) - 1); err != nil {
+			exit(exitUsage, "-split: ", err)
+		}
+	}
+
+	if *hdrOnly {
+		header := sds.HeaderFromIntBuffer(buffer, sendConfig.Channel, sendConfig.Number)
+		header.Length = uint(len(parts[0]))
+		if loop != nil && int(loop.End) < len(parts[0]) {
+			sds.SetLoopFromWAV(header, loop)
+		}
+		code := 0
+		for _, t := range targets {
+			h := header.Clone()
+			h.Channel = t.channel
+			cfg := sendConfig.TransferConfig
+			cfg.Log = t.logf
+			if c := sendHeaderOnly(ctx, t.conn, &cfg, h); code == 0 {
+				code = c
+			}
+		}
+		for _, t := range targets {
+			t.conn.Close()
+		}
+		os.Exit(code)
 	}
-	defer conn.Close()
-	doTransfer(&sendConfig, conn, buffer)
+
+	// Send the waveform data.
+	if len(targets) == 1 {
+		sendConfig.Channel = targets[0].channel
+		if err := sendParts(ctx, &sendConfig, targets[0].conn, buffer, parts, loop, *slotBase); err != nil {
+			exit(exitCode(err), err)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		t := t
+		cfg := sendConfig
+		cfg.Channel = t.channel
+		cfg.Log = t.logf
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.err = sendParts(ctx, &cfg, t.conn, buffer, parts, loop, *slotBase)
+			if t.err != nil {
+				t.logf("%v", t.err)
+			} else {
+				t.logf("done")
+			}
+		}()
+	}
+	wg.Wait()
+	var failed []string
+	code := 0
+	for _, t := range targets {
+		if t.err != nil {
+			failed = append(failed, t.name)
+			if code == 0 {
+				code = exitCode(t.err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		exit(code, fmt.Sprintf("transfer failed on %d of %d devices: %s", len(failed), len(targets), strings.Join(failed, ", ")))
+	}
+}
+
+// nakRetries converts the -nak-retries flag to TransferConfig.NakRetries, where
+// zero selects the default.
+func nakRetries(n int) int {
+	if n == 0 {
+		return sds.NoRetries
+	}
+	return n
+}
+
+// target is a device that the waveform is sent to.
+type target struct {
+	name    string
+	channel byte // sysex channel, from -ch or the device string
+	conn    *cmdutil.Conn
+	logf    func(format string, args ...interface{})
+	err     error // result of the transfer
+}
+
+// openTargets opens the given devices. The channel applies to devices which don't
+// specify their own. The preamble is sent to each device after opening it.
+func openTargets(devices []string, channel int, mc cmdutil.Config, notesOff bool, preMsg []byte) []*target {
+	targets := make([]*target, len(devices))
+	for i, dev := range devices {
+		ch := channel
+		dev, err := cmdutil.ParseDevice(dev, &ch)
+		if err != nil {
+			exit(exitUsage, "-dev: ", err)
+		}
+		t := &target{name: dev, channel: byte(ch), logf: log.Printf}
+		if len(devices) > 1 {
+			t.logf = log.New(log.Writer(), "["+dev+"] ", log.Flags()|log.Lmsgprefix).Printf
+		}
+		mc.InDevice = dev
+		if t.conn, err = cmdutil.Open(&mc); err != nil {
+			exit(exitDevice, err)
+		}
+		if mc.Timing {
+			go logTiming(t.conn, t.logf)
+		}
+		if notesOff || preMsg != nil {
+			if err := sendPreamble(t.conn, preMsg, notesOff); err != nil {
+				exit(exitDevice, err)
+			}
+		}
+		targets[i] = t
+	}
+	return targets
+}
+
+// sendParts transmits the parts of a split waveform to consecutive slots, starting
+// at the slot given in cfg. Transfers to different devices may run concurrently, so
+// the shared buffer is only read.
+func sendParts(ctx context.Context, cfg *sendConfig, conn *cmdutil.Conn, buffer *audio.IntBuffer, parts [][]int, loop *wav.SampleLoop, slotBase int) error {
+	for i, part := range parts {
+		pcfg := *cfg
+		pcfg.Number += uint16(i)
+		if i > 0 {
+			pcfg.ResumeFrom = 0
+			pcfg.ReleaseLoop = nil
+		}
+		waveform := *buffer
+		waveform.Data = part
+		if len(parts) > 1 {
+			pcfg.Log("sending part %d/%d to slot %d", i+1, len(parts), int(pcfg.Number)+slotBase)
+		}
+		var partLoop *wav.SampleLoop
+		if i == 0 && loop != nil {
+			if int(loop.End) < len(part) {
+				partLoop = loop
+			} else {
+				pcfg.Log("warning: loop end %d is beyond the first part, not transmitted", loop.End)
+			}
+		}
+		if err := doTransfer(ctx, &pcfg, conn, &waveform, partLoop); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func readWAV(file string) (*audio.IntBuffer, error) {
+// floatBitDepth is the bit depth that float WAV samples are converted to.
+const floatBitDepth = 24
+
+// readWAV reads a WAV file. It also returns the loop of the waveform, or nil if
+// there is none. The loop is taken from the first loop of the smpl chunk. Files
+// without a smpl chunk are checked for cue points marking a loop.
+func readWAV(file string) (*audio.IntBuffer, *wav.SampleLoop, error) {
 	fd, err := os.Open(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer fd.Close()
 
 	decoder := wav.NewDecoder(fd)
 	decoder.ReadInfo()
+	if err := decoder.Err(); err != nil {
+		return nil, nil, fmt.Errorf("invalid WAV file: %v", err)
+	}
+	var loop *wav.SampleLoop
+	decoder.ReadMetadata()
 	if decoder.Err() != nil {
-		return nil, err
+		return nil, nil, decoder.Err()
+	}
+	if m := decoder.Metadata; m != nil && m.SamplerInfo != nil && len(m.SamplerInfo.Loops) > 0 {
+		loop = m.SamplerInfo.Loops[0]
+	} else if m != nil && len(m.CuePoints) > 0 {
+		if loop, err = sds.CueLoop(fd); err != nil {
+			return nil, nil, fmt.Errorf("can't read cue points: %v", err)
+		}
+		if loop != nil {
+			log.Printf("using loop %d-%d from cue points", loop.Start, loop.End)
+		}
+	}
+
+	dataSize, err := sds.WAVDataSize(fd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid WAV file: %v", err)
+	}
+
+	// Reading metadata consumes the file, start over for the sample data.
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	decoder = wav.NewDecoder(fd)
+	buf, err := decoder.FullPCMBuffer()
+	if err != nil {
+		return nil, nil, err
 	}
-	return decoder.FullPCMBuffer()
+	// FullPCMBuffer stops at the end of the file without error, so check that the
+	// data chunk is complete. It also returns the padding of odd-sized chunks as a
+	// sample, which is removed here.
+	bytesPerSample := (buf.SourceBitDepth + 7) / 8
+	want := dataSize / bytesPerSample
+	if want == 0 {
+		return nil, nil, errors.New("WAV file has no sample data")
+	}
+	if len(buf.Data) < want {
+		return nil, nil, fmt.Errorf("file is truncated, has %d of %d samples", len(buf.Data), want)
+	}
+	buf.Data = buf.Data[:want]
+	if buf.Format == nil || buf.Format.SampleRate <= 0 {
+		return nil, nil, errors.New("WAV file has no sample rate")
+	}
+	switch {
+	case decoder.WavAudioFormat == sds.WAVFormatFloat:
+		if buf.SourceBitDepth != 32 {
+			return nil, nil, fmt.Errorf("unsupported %d-bit float WAV", buf.SourceBitDepth)
+		}
+		sds.FromWAVFloat(buf.Data, floatBitDepth)
+		buf.SourceBitDepth = floatBitDepth
+	case buf.SourceBitDepth > sds.MaxBitDepth:
+		sds.ConvertBitDepth(buf.Data, buf.SourceBitDepth, sds.MaxBitDepth)
+		buf.SourceBitDepth = sds.MaxBitDepth
+	default:
+		sds.FromWAVSamples(buf.Data, buf.SourceBitDepth)
+	}
+	return buf, loop, nil
 }
 
 func mixToMono(inputBuffer *audio.IntBuffer) *audio.IntBuffer {
@@ -73,142 +530,459 @@ func mixToMono(inputBuffer *audio.IntBuffer) *audio.IntBuffer {
 	return mono
 }
 
-type sendConfig struct {
-	Channel        int
-	WaveformNumber int
+// targetBitDepth returns the bit depth of the transmitted samples. The source bit
+// depth is used for "auto", clamped to the range supported by SDS.
+func targetBitDepth(flagValue string, source int) (int, error) {
+	if flagValue == "auto" {
+		switch {
+		case source < sds.MinBitDepth:
+			return sds.MinBitDepth, nil
+		case source > sds.MaxBitDepth:
+			return sds.MaxBitDepth, nil
+		default:
+			return source, nil
+		}
+	}
+	n, err := strconv.Atoi(flagValue)
+	if err != nil || n < sds.MinBitDepth || n > sds.MaxBitDepth {
+		return 0, fmt.Errorf("invalid bit depth %q, must be auto or %d..%d", flagValue, sds.MinBitDepth, sds.MaxBitDepth)
+	}
+	return n, nil
 }
 
-const (
-	handshakeTimeout    = 2 * time.Second
-	dataResponseTimeout = 20 * time.Millisecond
-)
+var controlNames = map[sds.ControlPacketType]string{
+	sds.Ack:    "ACK",
+	sds.Nak:    "NAK",
+	sds.Cancel: "CANCEL",
+	sds.Wait:   "WAIT",
+}
 
-// doTransfer sends the given waveform via SDS.
-func doTransfer(cfg *sendConfig, conn *cmdutil.Conn, waveform *audio.IntBuffer) {
-	header := &sds.DumpHeader{
-		Channel:  byte(cfg.Channel),
-		Number:   uint16(cfg.WaveformNumber),
-		BitDepth: byte(waveform.SourceBitDepth),
-		Period:   samplerateToPeriod(waveform.Format.SampleRate),
+// sendHeaderOnly transmits h and logs the control messages sent back by the receiver,
+// with the time since the header was sent. It collects responses until the receiver
+// is silent for cfg.HandshakeTimeout. If the receiver accepts the header, the dump
+// is cancelled. The result is the exit code for the last response.
+func sendHeaderOnly(ctx context.Context, tr sds.Transport, cfg *sds.TransferConfig, h *sds.DumpHeader) int {
+	cfg.Log(">> DumpHeader: waveform %d, %d bits, %d samples, %s", h.Number, h.BitDepth, h.Length, sds.FormatSampleRate(h.Period))
+	var (
+		code    = exitTimeout
+		channel = h.Channel // channel of the receiver, see sds.BroadcastChannel
+	)
+	_, err := sds.Exchange(ctx, tr, h, h.Channel, cfg, func(cp *sds.ControlPacket, d time.Duration) bool {
+		cfg.Log("<< +%v: %s (packet %d)", d.Round(time.Millisecond), controlNames[cp.Type], cp.PacketNumber)
+		switch cp.Type {
+		case sds.Ack:
+			code = 0
+			channel = cp.Channel
+		case sds.Nak, sds.Cancel:
+			code = exitDenied
+		}
+		return false
+	})
+	if err != nil {
+		cfg.Log("%v", err)
+		return exchangeExitCode(ctx)
 	}
-	transfer := sds.NewSendOp(waveform.Data, header)
+	if code == exitTimeout {
+		cfg.Log("no response to header")
+	}
+	if code == 0 {
+		cfg.Log(">> CANCEL")
+		tr.Send(sds.NewCancel(channel, 0))
+	}
+	return code
+}
 
-	// Begin transfer by sending header.
-	log.Println("requesting transfer")
-	send(conn, header)
+// exchangeExitCode returns the exit code for an error returned by sds.Exchange.
+func exchangeExitCode(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return exitTimeout
+	}
+	return exitDevice
+}
 
-	waiting := false
-	for {
-		switch msg := receive(conn, handshakeTimeout).(type) {
-		case nil:
-			if !waiting {
-				log.Println("receiver did not respond, assumed to be non-handshaking")
-				transferData(cfg, conn, transfer)
-				return
-			}
-		case *sds.ControlPacket:
-			if msg.Channel != byte(cfg.Channel) {
-				continue
-			}
-			waiting = false
-			switch msg.Type {
-			case sds.Ack:
-				if msg.PacketNumber != 0 {
-					continue
-				}
-				log.Println("<< ACK")
-				transferData(cfg, conn, transfer)
-				return
-			case sds.Nak:
-				log.Fatal("transfer denied: NAK response")
-			case sds.Cancel:
-				log.Fatal("transfer denied: CANCEL response")
-			case sds.Wait:
-				log.Println("<< WAIT")
-				waiting = true
-				continue
-			}
-		default:
-			log.Printf("ignoring message %#v", msg)
+// loopFlags are the flags of -loop-only and those it can't be combined with.
+type loopFlags struct {
+	loopOnly   bool
+	start, end int
+	typ        string
+	nameSlot   bool
+	hdrOnly    bool
+	serve      bool
+	verify     bool
+	resume     int
+}
+
+// check validates the -loop-only flags.
+func (f *loopFlags) check() error {
+	if !f.loopOnly {
+		if f.start != 0 || f.end != 0 || f.typ != "forward" {
+			return errors.New("-loop-start/-loop-end/-loop-type require -loop-only")
 		}
+		return nil
+	}
+	if f.hdrOnly || f.serve || f.verify || f.resume > 0 {
+		return errors.New("-loop-only can't be used with -header-only, -serve, -verify or -resume-from")
+	}
+	if f.nameSlot {
+		return errors.New("-loop-only can't be used with -number-from-name, it doesn't take a wave file")
+	}
+	if f.end <= 0 || f.start < 0 || f.start > f.end || f.end > sds.MaxLength {
+		return fmt.Errorf("-loop-only: invalid loop, need 0 <= -loop-start <= -loop-end <= %d", sds.MaxLength)
 	}
+	if _, ok := loopTypes[f.typ]; !ok {
+		return fmt.Errorf("-loop-type: invalid type %s, must be forward or pingpong", f.typ)
+	}
+	return nil
 }
 
-func transferData(cfg *sendConfig, conn *cmdutil.Conn, transfer *sds.SendOp) {
-	var (
-		progress int
-		waiting  bool
-	)
-	for !transfer.Done() {
-		if !waiting {
-			send(conn, transfer.NextMessage())
-		}
-		switch msg := receive(conn, dataResponseTimeout).(type) {
-		case nil:
-			// ignore
-		case *sds.ControlPacket:
-			if msg.Channel != byte(cfg.Channel) {
-				continue
-			}
-			waiting = false
-			switch msg.Type {
-			case sds.Ack:
-				// Packet confirmed.
-			case sds.Nak:
-				log.Fatalf("<< NAK (packet %d)", msg.PacketNumber)
-			case sds.Cancel:
-				log.Fatalf("<< CANCEL")
-			case sds.Wait:
-				log.Println("<< WAIT")
-				waiting = true
-			}
+// loopTypes are the values of -loop-type.
+var loopTypes = map[string]byte{
+	"forward":  sds.LoopForward,
+	"pingpong": sds.LoopPingPong,
+}
+
+// sendLoopOnly transmits lp and waits for the receiver to acknowledge it. The result
+// is the exit code.
+func sendLoopOnly(ctx context.Context, tr sds.Transport, cfg *sds.TransferConfig, lp *sds.LoopPoint) int {
+	cfg.Log(">> LoopPoint: waveform %d, loop %d-%d", lp.Number, lp.Start, lp.End)
+	code := exitTimeout
+	answered, err := sds.Exchange(ctx, tr, lp, lp.Channel, cfg, func(cp *sds.ControlPacket, _ time.Duration) bool {
+		cfg.Log("<< %s", controlNames[cp.Type])
+		switch cp.Type {
+		case sds.Ack:
+			cfg.Log("loop set")
+			code = 0
+			return true
+		case sds.Nak, sds.Cancel:
+			code = exitDenied
+			return true
 		}
+		return false
+	})
+	if err != nil {
+		cfg.Log("%v", err)
+		return exchangeExitCode(ctx)
+	}
+	if !answered {
+		cfg.Log("no response, loop may not have been applied")
+	}
+	return code
+}
+
+// probeFallbackDepths are the bit depths tried by probeBitDepth.
+var probeFallbackDepths = []int{24, 16, 12, 8}
 
-		p := transfer.Progress()
-		if p-progress > 5 || (p == 100 && progress != 100) {
-			progress = p
-			log.Printf("progress: %d%%", progress)
+// probeBitDepth returns the highest bit depth up to max that the receiver accepts.
+// If the receiver doesn't respond to the probe, max is returned.
+func probeBitDepth(ctx context.Context, t *target, h *sds.DumpHeader, max int) int {
+	candidates := []int{max}
+	for _, d := range probeFallbackDepths {
+		if d < max {
+			candidates = append(candidates, d)
 		}
 	}
+	for _, depth := range candidates {
+		ok, err := sds.ProbeBitDepth(ctx, t.conn, h, depth, &sds.TransferConfig{Log: t.logf})
+		if errors.Is(err, sds.ErrTimeout) {
+			t.logf("receiver did not respond to probe, using %d bits", max)
+			return max
+		} else if err != nil {
+			exit(transferExitCode(err), "-probe-bits: ", err)
+		}
+		if ok {
+			return depth
+		}
+		t.logf("receiver rejected %d bits", depth)
+	}
+	exit(exitDenied, "-probe-bits: receiver rejected all bit depths")
+	return 0
 }
 
-func send(conn *cmdutil.Conn, msg sds.Message) {
-	_, err := conn.Write(msg.Encode(nil))
-	if err != nil {
-		log.Fatal(err)
+// fitLoop resamples the loop region of buf so that the loop is n samples long, and
+// returns the adjusted loop. If loop is nil, the whole waveform is resampled and
+// looped.
+func fitLoop(buf *audio.IntBuffer, loop *wav.SampleLoop, n int) (*wav.SampleLoop, error) {
+	if loop == nil {
+		if len(buf.Data) == 0 {
+			return nil, errors.New("empty waveform")
+		}
+		buf.Data = sds.ResampleLoop(buf.Data, n)
+		return &wav.SampleLoop{Type: 0, Start: 0, End: uint32(n - 1)}, nil
+	}
+	start, end := int(loop.Start), int(loop.End)
+	if start > end || end >= len(buf.Data) {
+		return nil, fmt.Errorf("loop %d-%d is outside of waveform", start, end)
 	}
+	resampled := sds.ResampleLoop(buf.Data[start:end+1], n)
+	data := make([]int, 0, len(buf.Data)-(end-start+1)+n)
+	data = append(data, buf.Data[:start]...)
+	data = append(data, resampled...)
+	data = append(data, buf.Data[end+1:]...)
+	buf.Data = data
+
+	fitted := *loop
+	fitted.End = uint32(start + n - 1)
+	return &fitted, nil
 }
 
-func receive(conn *cmdutil.Conn, timeout time.Duration) sds.Message {
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+// padLength returns the length that a waveform of n samples is padded to. The mode
+// is "packet" for a multiple of the packet sample count, or "pow2" for a power of two.
+func padLength(n, bitDepth int, mode string) int {
+	if mode == "pow2" {
+		p := 1
+		for p < n {
+			p <<= 1
+		}
+		return p
+	}
+	count := new(sds.DataPacket).SampleCount(bitDepth)
+	return (n + count - 1) / count * count
+}
+
+// padWaveform extends buf to the length given by padLength and returns the loop of
+// the padded waveform. The padding consists of zero samples appended to the
+// waveform. When repeat is set, the padding is inserted after the loop instead and
+// continues the loop region, and the loop end is moved to cover it. Repeating
+// requires a loop.
+func padWaveform(buf *audio.IntBuffer, loop *wav.SampleLoop, mode string, repeat bool) (*wav.SampleLoop, error) {
+	n := len(buf.Data)
+	if n == 0 {
+		return nil, errors.New("empty waveform")
+	}
+	if loop != nil && (loop.Start > loop.End || int(loop.End) >= n) {
+		return nil, fmt.Errorf("loop %d-%d is outside of waveform", loop.Start, loop.End)
+	}
+	if repeat && loop == nil {
+		return nil, errors.New("waveform has no loop to repeat")
+	}
+	padded := padLength(n, buf.SourceBitDepth, mode)
+	if padded > sds.MaxLength {
+		return nil, fmt.Errorf("padded length %d exceeds max. length %d", padded, sds.MaxLength)
+	}
+	if !repeat {
+		for i := n; i < padded; i++ {
+			buf.Data = append(buf.Data, 0)
+		}
+		return loop, nil
+	}
+	start, end := int(loop.Start), int(loop.End)
+	data := make([]int, 0, padded)
+	data = append(data, buf.Data[:end+1]...)
+	for i := 0; i < padded-n; i++ {
+		data = append(data, buf.Data[start+i%(end-start+1)])
+	}
+	data = append(data, buf.Data[end+1:]...)
+	buf.Data = data
+
+	extended := *loop
+	extended.End = uint32(end + padded - n)
+	return &extended, nil
+}
+
+type sendConfig struct {
+	sds.TransferConfig                // Channel and Number select the target slot
+	Verify             bool           // read back the waveform after sending
+	Serve              bool           // wait for DumpRequest before sending
+	Progress           string         // progress display: bar, log or none
+	ReleaseLoop        *sds.LoopPoint // sent as loop 1 after the dump
+}
+
+// logTiming logs the messages received on conn with their time delta.
+func logTiming(conn *cmdutil.Conn, logf func(string, ...interface{})) {
 	for {
 		select {
-		case rawmsg := <-conn.PacketCh:
-			msg, err := sds.Decode(rawmsg)
-			if err != nil {
-				log.Printf("msg %x: %v", rawmsg, err)
-				continue
+		case m := <-conn.TimedCh:
+			prefix := m.Data
+			if len(prefix) > 6 {
+				prefix = prefix[:6]
 			}
-			return msg
-		case <-timer.C:
-			return nil
+			logf("<< +%v: %X... (%d bytes)", m.Delta, prefix, len(m.Data))
+		case <-conn.CloseCh:
+			return
 		}
 	}
 }
 
-func wait(conn *cmdutil.Conn) sds.Message {
+// preambleDelay is the time given to the device to process the messages sent before
+// the dump.
+const preambleDelay = 200 * time.Millisecond
+
+// sendPreamble sends All Notes Off and/or a custom sysex message before the dump.
+func sendPreamble(conn *cmdutil.Conn, sysex []byte, notesOff bool) error {
+	if notesOff {
+		log.Println("sending All Notes Off")
+		for ch := byte(0); ch < 16; ch++ {
+			if _, err := conn.Write([]byte{0xB0 | ch, 0x7B, 0x00}); err != nil {
+				return err
+			}
+		}
+	}
+	if sysex != nil {
+		log.Printf("sending pre-dump sysex %X", sysex)
+		if _, err := conn.Write(sysex); err != nil {
+			return err
+		}
+	}
+	time.Sleep(preambleDelay)
+	return nil
+}
+
+// doTransfer sends the given waveform via SDS.
+func doTransfer(ctx context.Context, cfg *sendConfig, conn *cmdutil.Conn, waveform *audio.IntBuffer, loop *wav.SampleLoop) error {
+	header := sds.HeaderFromIntBuffer(waveform, cfg.Channel, cfg.Number)
+	if loop != nil {
+		sds.SetLoopFromWAV(header, loop)
+		cfg.Log("loop: %d-%d, type %#x", header.LoopStart, header.LoopEnd, header.LoopType)
+	}
+	if err := header.Validate(); err != nil {
+		return &codeError{exitFile, err}
+	}
+	checkSampleRate(cfg.Log, waveform.Format.SampleRate, header.Period)
+	cfg.Log("sample rate: %s", sds.FormatSampleRate(header.Period))
+	if cfg.Serve {
+		if err := waitRequest(ctx, cfg, conn, header.Channel, header.Number); err != nil {
+			return err
+		}
+	}
+	transfer := sds.NewSendOp(waveform.Data, header)
+	runConfig := cfg.TransferConfig
+	if cfg.ReleaseLoop != nil {
+		if cfg.ReleaseLoop.End >= header.Length {
+			return &codeError{exitUsage, fmt.Errorf("release loop end %d is beyond the waveform", cfg.ReleaseLoop.End)}
+		}
+		runConfig.Loops = []sds.LoopPoint{*cfg.ReleaseLoop}
+	}
+	switch cfg.Progress {
+	case "bar":
+		runConfig.OnProgress = newProgressBar(os.Stderr).update
+	case "none":
+		runConfig.OnProgress = func(sent, total int) {}
+	}
+	if err := transfer.Run(ctx, conn, &runConfig); err != nil {
+		return err
+	}
+	if cfg.Confirm && !transfer.Confirmed() {
+		return &codeError{exitUnconfirmed, errors.New("transfer was not confirmed by receiver")}
+	}
+	if cfg.Verify {
+		return verifyTransfer(ctx, cfg, conn, header, waveform.Data)
+	}
+	return nil
+}
+
+// waitRequest waits for a DumpRequest for the given waveform.
+func waitRequest(ctx context.Context, cfg *sendConfig, conn *cmdutil.Conn, channel byte, number uint16) error {
+	cfg.Log("waiting for DumpRequest for waveform %d", number)
 	for {
-		msg := receive(conn, 2*time.Second)
+		msg, err := conn.Receive(ctx)
+		if err != nil {
+			return err
+		}
 		switch msg := msg.(type) {
-		case *sds.ControlPacket:
-			if msg.Type != sds.Wait {
-				return msg
+		case *sds.DumpRequest:
+			if msg.Channel != channel {
+				continue
+			}
+			if msg.Number != number {
+				cfg.Log("ignoring DumpRequest for waveform %d", msg.Number)
+				continue
 			}
+			cfg.Log("<< DumpRequest")
+			return nil
+		}
+	}
+}
+
+// verifyTransfer requests the waveform that was just sent and compares it
+// against the original samples.
+func verifyTransfer(ctx context.Context, cfg *sendConfig, conn *cmdutil.Conn, header *sds.DumpHeader, samples []int) error {
+	cfg.Log("verifying transfer")
+	rh, received, err := sds.ReceiveDump(ctx, conn, &sds.TransferConfig{
+		Channel: header.Channel,
+		Request: true,
+		Number:  header.Number,
+	})
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	for _, d := range header.Diff(rh) {
+		cfg.Log("verify: header field differs (sent vs. received): %s", d)
+	}
+	if rh.BitDepth != header.BitDepth {
+		return verifyFailed("device returned %d-bit waveform, sent %d bits", rh.BitDepth, header.BitDepth)
+	}
+	if len(received) != len(samples) {
+		return verifyFailed("device returned %d samples, sent %d", len(received), len(samples))
+	}
+	for i := range samples {
+		if received[i] != samples[i] {
+			return verifyFailed("sample %d differs (sent %d, received %d)", i, samples[i], received[i])
 		}
 	}
+	cfg.Log("verify: PASS")
+	return nil
+}
+
+func verifyFailed(format string, args ...interface{}) error {
+	return &codeError{exitVerify, fmt.Errorf("verify: FAIL: "+format, args...)}
+}
+
+// Exit codes, see package documentation.
+const (
+	exitError       = 1
+	exitUsage       = 2
+	exitFile        = 3
+	exitDevice      = 4
+	exitDenied      = 5
+	exitTimeout     = 6
+	exitUnconfirmed = 7
+	exitVerify      = 8
+)
+
+// exit logs its arguments and terminates the program with the given exit code.
+func exit(code int, args ...interface{}) {
+	log.Print(args...)
+	os.Exit(code)
+}
+
+// codeError is an error that terminates the program with a specific exit code.
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+func (e *codeError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code for an error returned by doTransfer.
+func exitCode(err error) int {
+	var ee *codeError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return transferExitCode(err)
 }
 
-func samplerateToPeriod(rate int) uint {
-	return uint(1000000000 / rate)
+// transferExitCode returns the exit code for an error returned by a transfer.
+func transferExitCode(err error) int {
+	switch {
+	case errors.Is(err, sds.ErrDenied):
+		return exitDenied
+	case errors.Is(err, sds.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	default:
+		return exitError
+	}
+}
+
+// sampleRateTolerance is the relative deviation between the source sample rate and
+// the rate implied by the transmitted period that triggers a warning.
+const sampleRateTolerance = 0.001
+
+// checkSampleRate warns when the sample period can't represent the rate accurately.
+func checkSampleRate(logf func(string, ...interface{}), rate int, period uint) {
+	actual := sds.PeriodToSampleRate(period)
+	if math.Abs(actual-float64(rate))/float64(rate) > sampleRateTolerance {
+		logf("warning: sample rate %d Hz is transmitted as period %dns (%s)", rate, period, sds.FormatSampleRate(period))
+	}
 }
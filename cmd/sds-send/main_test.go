@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/internal/sdstest"
+	"github.com/fjl/sds/sds"
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+type mockReceiver = sdstest.Receiver[sds.Message]
+
+var newMockReceiver = sdstest.NewReceiver[sds.Message]
+
+func TestReadWAV(t *testing.T) {
+	files, err := filepath.Glob("../../sds/testdata/*.wav")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+	for _, file := range files {
+		buf, _, err := readWAV(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+		} else if len(buf.Data) == 0 {
+			t.Errorf("%s: no samples", file)
+		}
+	}
+}
+
+func TestReadWAVTruncated(t *testing.T) {
+	raw, err := os.ReadFile("../../sds/testdata/akwf1_16bit_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "in.wav")
+	if err := os.WriteFile(file, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readWAV(file); err != nil {
+		t.Fatal("error for intact file:", err)
+	}
+
+	for _, size := range []int{0, 8, 30, 40, 44, len(raw) - 100} {
+		if err := os.WriteFile(file, raw[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if buf, _, err := readWAV(file); err == nil {
+			t.Errorf("no error for file truncated to %d bytes (%d samples)", size, len(buf.Data))
+		}
+	}
+}
+
+func TestReadWAVZeroRate(t *testing.T) {
+	raw, err := os.ReadFile("../../sds/testdata/akwf1_16bit_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw = append([]byte(nil), raw...)
+	copy(raw[24:28], []byte{0, 0, 0, 0}) // sample rate in fmt chunk
+	file := filepath.Join(t.TempDir(), "in.wav")
+	if err := os.WriteFile(file, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readWAV(file); err == nil {
+		t.Fatal("no error for zero sample rate")
+	}
+}
+
+// This checks that 8-bit WAV files written like sds-recv does are read back by
+// readWAV with the same signed sample values. 8-bit WAV samples are unsigned, so both
+// directions must convert.
+//
+// The waveform has an odd number of samples, so the data chunk is padded when the
+// file has a smpl chunk after it.
+func TestReadWAV8BitRoundTrip(t *testing.T) {
+	samples := []int{-128, 127, 0, -1, 1, -64, 63}
+	for _, loopType := range []byte{sds.LoopNone, sds.LoopForward} {
+		h := &sds.DumpHeader{
+			BitDepth: 8,
+			Period:   sds.SampleRateToPeriod(44100),
+			Length:   uint(len(samples)),
+			LoopEnd:  uint(len(samples) - 1),
+			LoopType: loopType,
+		}
+		file := filepath.Join(t.TempDir(), "8bit.wav")
+		fd, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sds.WriteSDSToWAV(fd, h, samples, 8, nil); err != nil {
+			t.Fatal(err)
+		}
+		fd.Close()
+
+		buf, loop, err := readWAV(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.SourceBitDepth != 8 {
+			t.Fatalf("wrong bit depth %d", buf.SourceBitDepth)
+		}
+		if !reflect.DeepEqual(buf.Data, samples) {
+			t.Errorf("loop type %#x: wrong samples %d, want %d", loopType, buf.Data, samples)
+		}
+		if (loop != nil) != (loopType != sds.LoopNone) {
+			t.Errorf("loop type %#x: wrong loop %v", loopType, loop)
+		}
+	}
+}
+
+// This checks readWAV against the SDS dump of the same 8-bit waveform.
+func TestReadWAV8BitMatchesSDS(t *testing.T) {
+	buf, _, err := readWAV("../../sds/testdata/akwf1_8bit_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile("../../sds/testdata/akwf1_8bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sds.NewSampleReader(sds.NewDecoder(bytes.NewReader(raw)))
+	var want []int
+	for {
+		block, err := r.ReadSamples()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, block...)
+	}
+	if !reflect.DeepEqual(buf.Data, want) {
+		t.Fatalf("samples differ from SDS file\n got %d\nwant %d", buf.Data, want)
+	}
+}
+
+func TestPadLength(t *testing.T) {
+	tests := []struct {
+		n, bitDepth int
+		mode        string
+		want        int
+	}{
+		{1, 16, "pow2", 1},
+		{3, 16, "pow2", 4},
+		{64, 16, "pow2", 64},
+		{65, 16, "pow2", 128},
+		{1, 16, "packet", 40},
+		{40, 16, "packet", 40},
+		{41, 16, "packet", 80},
+		{41, 8, "packet", 60},
+		{61, 8, "packet", 120},
+		{31, 24, "packet", 60},
+	}
+	for _, test := range tests {
+		if got := padLength(test.n, test.bitDepth, test.mode); got != test.want {
+			t.Errorf("padLength(%d, %d, %q) = %d, want %d", test.n, test.bitDepth, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestPadWaveform(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []int
+		loop     *wav.SampleLoop
+		repeat   bool
+		want     []int
+		wantLoop *wav.SampleLoop
+	}{
+		{
+			name: "no loop",
+			data: []int{1, 2, 3},
+			want: []int{1, 2, 3, 0},
+		},
+		{
+			name:     "loop",
+			data:     []int{1, 2, 3, 4, 5},
+			loop:     &wav.SampleLoop{Start: 1, End: 2},
+			want:     []int{1, 2, 3, 4, 5, 0, 0, 0},
+			wantLoop: &wav.SampleLoop{Start: 1, End: 2},
+		},
+		{
+			name:     "loop, repeat",
+			data:     []int{1, 2, 3, 4, 5},
+			loop:     &wav.SampleLoop{Start: 1, End: 3},
+			repeat:   true,
+			want:     []int{1, 2, 3, 4, 2, 3, 4, 5},
+			wantLoop: &wav.SampleLoop{Start: 1, End: 6},
+		},
+		{
+			name:     "loop at end, repeat",
+			data:     []int{1, 2, 3, 4, 5},
+			loop:     &wav.SampleLoop{Start: 3, End: 4},
+			repeat:   true,
+			want:     []int{1, 2, 3, 4, 5, 4, 5, 4},
+			wantLoop: &wav.SampleLoop{Start: 3, End: 7},
+		},
+		{
+			name:     "exact length",
+			data:     []int{1, 2, 3, 4},
+			loop:     &wav.SampleLoop{Start: 2, End: 3},
+			repeat:   true,
+			want:     []int{1, 2, 3, 4},
+			wantLoop: &wav.SampleLoop{Start: 2, End: 3},
+		},
+	}
+	for _, test := range tests {
+		buf := &audio.IntBuffer{Data: append([]int{}, test.data...), SourceBitDepth: 16}
+		loop, err := padWaveform(buf, test.loop, "pow2", test.repeat)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(buf.Data, test.want) {
+			t.Errorf("%s: wrong samples %d, want %d", test.name, buf.Data, test.want)
+		}
+		if !reflect.DeepEqual(loop, test.wantLoop) {
+			t.Errorf("%s: wrong loop %+v, want %+v", test.name, loop, test.wantLoop)
+		}
+	}
+}
+
+func TestPadWaveformPacket(t *testing.T) {
+	buf := &audio.IntBuffer{Data: make([]int, 41), SourceBitDepth: 8}
+	for i := range buf.Data {
+		buf.Data[i] = i + 1
+	}
+	loop, err := padWaveform(buf, &wav.SampleLoop{Start: 0, End: 40}, "packet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.Data) != 60 {
+		t.Fatalf("padded to %d samples, want 60", len(buf.Data))
+	}
+	for i := 41; i < 60; i++ {
+		if buf.Data[i] != (i%41)+1 {
+			t.Fatalf("wrong padding at %d: %d", i, buf.Data[i])
+		}
+	}
+	if loop.Start != 0 || loop.End != 59 {
+		t.Fatalf("wrong loop %+v", *loop)
+	}
+}
+
+func TestPadWaveformErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []int
+		loop   *wav.SampleLoop
+		repeat bool
+	}{
+		{"empty", nil, nil, false},
+		{"loop end", []int{1, 2, 3}, &wav.SampleLoop{Start: 0, End: 3}, false},
+		{"loop order", []int{1, 2, 3}, &wav.SampleLoop{Start: 2, End: 1}, false},
+		{"too long", make([]int, sds.MaxLength+1), nil, false},
+		{"repeat without loop", []int{1, 2, 3}, nil, true},
+	}
+	for _, test := range tests {
+		buf := &audio.IntBuffer{Data: test.data, SourceBitDepth: 16}
+		if _, err := padWaveform(buf, test.loop, "pow2", test.repeat); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestLoopFlags(t *testing.T) {
+	tests := []struct {
+		flags loopFlags
+		ok    bool
+	}{
+		{loopFlags{typ: "forward"}, true},
+		{loopFlags{typ: "forward", start: 10}, false},
+		{loopFlags{typ: "forward", end: 10}, false},
+		{loopFlags{typ: "forward", loopOnly: true, start: 0, end: 10}, true},
+		{loopFlags{typ: "forward", loopOnly: true, start: 10, end: 10}, true},
+		{loopFlags{typ: "forward", loopOnly: true, start: 11, end: 10}, false},
+		{loopFlags{typ: "forward", loopOnly: true, start: -1, end: 10}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 0}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: sds.MaxLength + 1}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 10, nameSlot: true}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 10, hdrOnly: true}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 10, serve: true}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 10, verify: true}, false},
+		{loopFlags{typ: "forward", loopOnly: true, end: 10, resume: 3}, false},
+		{loopFlags{typ: "pingpong"}, false},
+		{loopFlags{loopOnly: true, end: 10, typ: "pingpong"}, true},
+		{loopFlags{loopOnly: true, end: 10, typ: "backward"}, false},
+	}
+	for _, test := range tests {
+		if err := test.flags.check(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v", test.flags, err)
+		}
+	}
+}
+
+func TestSendLoopOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []sds.Message
+		want      int
+	}{
+		{"ack", []sds.Message{sds.NewAck(1, 0)}, 0},
+		{"nak", []sds.Message{sds.NewNak(1, 0)}, exitDenied},
+		{"cancel", []sds.Message{sds.NewCancel(1, 0)}, exitDenied},
+		{"wait", []sds.Message{sds.NewWait(1, 0), sds.NewAck(1, 0)}, 0},
+		{"other channel", []sds.Message{sds.NewAck(2, 0)}, exitTimeout},
+		{"timeout", nil, exitTimeout},
+	}
+	cfg := &sds.TransferConfig{HandshakeTimeout: 50 * time.Millisecond, Log: t.Logf}
+	for _, test := range tests {
+		r := newMockReceiver(func(r *mockReceiver, msg sds.Message) {
+			for _, resp := range test.responses {
+				r.Respond(resp, 0)
+			}
+		})
+		lp := &sds.LoopPoint{Channel: 1, Number: 2, Type: sds.LoopForward, Start: 10, End: 20}
+		if code := sendLoopOnly(context.Background(), r, cfg, lp); code != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, code, test.want)
+		}
+		if got := r.Received(); len(got) != 1 || got[0] != lp {
+			t.Errorf("%s: receiver got %v", test.name, got)
+		}
+	}
+}
+
+// This checks that sendLoopOnly waits for HeaderWaitTimeout after WAIT.
+func TestSendLoopOnlyWait(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg sds.Message) {
+		r.Respond(sds.NewWait(1, 0), 0)
+		r.Respond(sds.NewAck(1, 0), 100*time.Millisecond)
+	})
+	cfg := &sds.TransferConfig{HandshakeTimeout: 20 * time.Millisecond, HeaderWaitTimeout: time.Second, Log: t.Logf}
+	lp := &sds.LoopPoint{Channel: 1, Number: 2, Type: sds.LoopForward, Start: 10, End: 20}
+	if code := sendLoopOnly(context.Background(), r, cfg, lp); code != 0 {
+		t.Fatalf("exit code %d, want 0", code)
+	}
+}
+
+func TestSendHeaderOnly(t *testing.T) {
+	// The receiver answers a broadcast header on its own channel.
+	r := newMockReceiver(func(r *mockReceiver, msg sds.Message) {
+		if _, ok := msg.(*sds.DumpHeader); ok {
+			r.Respond(sds.NewWait(4, 0), 0)
+			r.Respond(sds.NewAck(4, 0), 0)
+		}
+	})
+	cfg := &sds.TransferConfig{HandshakeTimeout: 20 * time.Millisecond, Log: t.Logf}
+	h := &sds.DumpHeader{Channel: sds.BroadcastChannel, Number: 1, BitDepth: 16, Period: 22675, Length: 100}
+	if code := sendHeaderOnly(context.Background(), r, cfg, h); code != 0 {
+		t.Fatalf("exit code %d, want 0", code)
+	}
+	got := r.Received()
+	if len(got) != 2 {
+		t.Fatalf("receiver got %d messages, want header and CANCEL", len(got))
+	}
+	if cp, ok := got[1].(*sds.ControlPacket); !ok || cp.Type != sds.Cancel || cp.Channel != 4 {
+		t.Fatalf("wrong last message %#v", got[1])
+	}
+}
+
+func TestNakRetries(t *testing.T) {
+	if n := nakRetries(0); n != sds.NoRetries {
+		t.Errorf("nakRetries(0) = %d, want NoRetries", n)
+	}
+	if n := nakRetries(3); n != 3 {
+		t.Errorf("nakRetries(3) = %d", n)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressBarWidth is the number of characters in the bar.
+const progressBarWidth = 30
+
+// progressBar renders transfer progress as a single updating line.
+type progressBar struct {
+	w     io.Writer
+	start time.Time
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w, start: time.Now()}
+}
+
+// update redraws the bar. It is used as TransferConfig.OnProgress.
+func (b *progressBar) update(sent, total int) {
+	if total == 0 {
+		return
+	}
+	filled := sent * progressBarWidth / total
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	eta := "?"
+	if sent > 0 {
+		elapsed := time.Since(b.start)
+		remaining := elapsed * time.Duration(total-sent) / time.Duration(sent)
+		eta = remaining.Round(time.Second).String()
+	}
+	fmt.Fprintf(b.w, "\r[%s] %d/%d %3d%% ETA %s\x1b[K", bar, sent, total, sent*100/total, eta)
+	if sent == total {
+		fmt.Fprintln(b.w)
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,156 @@
+package cmdutil
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ValidateChannel checks that ch is a valid sysex channel number.
+func ValidateChannel(ch int) error {
+	if ch < 0 || ch > 127 {
+		return fmt.Errorf("invalid channel %d, must be in range 0..127", ch)
+	}
+	return nil
+}
+
+// ValidateWaveformNumber checks that n is a valid waveform number.
+func ValidateWaveformNumber(n int) error {
+	if n < 0 || n > 16383 {
+		return fmt.Errorf("invalid waveform number %d, must be in range 0..16383", n)
+	}
+	return nil
+}
+
+// channelSuffix introduces the sysex channel in a device selection string.
+const channelSuffix = ":ch"
+
+// ParseDevice splits a device selection string of the form "name:chN", which selects
+// both the MIDI port and the sysex channel N. If the string has the channel suffix,
+// *channel is set to N. Otherwise the string is returned unchanged and *channel is
+// not modified.
+func ParseDevice(s string, channel *int) (string, error) {
+	i := strings.LastIndex(s, channelSuffix)
+	if i < 0 {
+		return s, nil
+	}
+	digits := s[i+len(channelSuffix):]
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return s, nil // part of the device name
+	}
+	ch, err := strconv.Atoi(digits)
+	if err == nil {
+		err = ValidateChannel(ch)
+	}
+	if err != nil {
+		return "", fmt.Errorf("device %q: %v", s, err)
+	}
+	*channel = ch
+	return s[:i], nil
+}
+
+// WaveformNumber converts a slot number in the numbering convention of a device to
+// the waveform number used in SDS messages. The device numbers its slots starting
+// at base, which must be 0 or 1.
+func WaveformNumber(slot, base int) (int, error) {
+	if base != 0 && base != 1 {
+		return 0, fmt.Errorf("invalid slot base %d, must be 0 or 1", base)
+	}
+	n := slot - base
+	if err := ValidateWaveformNumber(n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ParseSlot parses a slot number, given in decimal or as hex with the 0x prefix.
+// Decimal numbers with leading zeros are rejected: they would be read as octal by
+// the flag package, which is unlikely to be what the user meant.
+func ParseSlot(s string) (int, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hex number %q", s)
+		}
+		return int(n), nil
+	}
+	if len(s) > 1 && s[0] == '0' {
+		d := strings.TrimLeft(s, "0")
+		if d == "" {
+			d = "0"
+		}
+		return 0, fmt.Errorf("leading zeros are not allowed in %q, write %s", s, d)
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+// slotValue is a flag.Value for slot numbers.
+type slotValue int
+
+func (v *slotValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *slotValue) Set(s string) error {
+	n, err := ParseSlot(s)
+	if err != nil {
+		return err
+	}
+	*v = slotValue(n)
+	return nil
+}
+
+// SlotFlag defines a slot number flag, like flag.Int. The value is parsed with
+// ParseSlot.
+func SlotFlag(name string, value int, usage string) *int {
+	p := &value
+	flag.Var((*slotValue)(p), name, usage)
+	return p
+}
+
+// SlotFromName parses the slot number from the leading digits of the base name of
+// file, e.g. 12 for "dir/012-saw.wav". It returns false if the name doesn't start
+// with a number.
+func SlotFromName(file string) (int, bool) {
+	name := filepath.Base(file)
+	end := 0
+	for end < len(name) && name[end] >= '0' && name[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(name[:end])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// namedSysex contains the messages that ParseSysex accepts by name.
+var namedSysex = map[string][]byte{
+	"gm-reset": {0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7}, // General MIDI System On
+}
+
+// ParseSysex parses a sysex message given as hex bytes, which may be separated by
+// spaces. It also accepts the name "gm-reset" for the universal General MIDI reset.
+func ParseSysex(s string) ([]byte, error) {
+	if msg, ok := namedSysex[s]; ok {
+		return msg, nil
+	}
+	msg, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+	if len(msg) < 2 || msg[0] != 0xF0 || msg[len(msg)-1] != 0xF7 {
+		return nil, fmt.Errorf("sysex message must start with F0 and end with F7")
+	}
+	for _, b := range msg[1 : len(msg)-1] {
+		if b > 0x7F {
+			return nil, fmt.Errorf("invalid data byte %#x in sysex message", b)
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,156 @@
+package cmdutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, ch := range []int{0, 1, 127} {
+		if err := ValidateChannel(ch); err != nil {
+			t.Errorf("channel %d: unexpected error %v", ch, err)
+		}
+	}
+	for _, ch := range []int{-1, 128, 200} {
+		if err := ValidateChannel(ch); err == nil {
+			t.Errorf("channel %d: expected error", ch)
+		}
+	}
+	for _, n := range []int{0, 16383} {
+		if err := ValidateWaveformNumber(n); err != nil {
+			t.Errorf("number %d: unexpected error %v", n, err)
+		}
+	}
+	for _, n := range []int{-1, 16384} {
+		if err := ValidateWaveformNumber(n); err == nil {
+			t.Errorf("number %d: expected error", n)
+		}
+	}
+}
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		in   string
+		dev  string
+		ch   int
+		fail bool
+	}{
+		{"", "", 3, false},
+		{"MySampler", "MySampler", 3, false},
+		{"MySampler:ch2", "MySampler", 2, false},
+		{"USB MIDI:USB MIDI 1 20:0:ch127", "USB MIDI:USB MIDI 1 20:0", 127, false},
+		{"USB MIDI 20:0", "USB MIDI 20:0", 3, false},
+		{"chorus:chx", "chorus:chx", 3, false},
+		{"MySampler:ch128", "", 3, true},
+	}
+	for _, test := range tests {
+		ch := 3
+		dev, err := ParseDevice(test.in, &ch)
+		if (err != nil) != test.fail {
+			t.Errorf("%q: unexpected error result %v", test.in, err)
+			continue
+		}
+		if !test.fail && (dev != test.dev || ch != test.ch) {
+			t.Errorf("%q: got %q, channel %d, want %q, channel %d", test.in, dev, ch, test.dev, test.ch)
+		}
+	}
+}
+
+func TestWaveformNumber(t *testing.T) {
+	tests := []struct {
+		slot, base, n int
+		err           bool
+	}{
+		{0, 0, 0, false},
+		{1, 1, 0, false},
+		{16, 1, 15, false},
+		{16384, 1, 16383, false},
+		{0, 1, 0, true},
+		{16384, 0, 0, true},
+		{5, 2, 0, true},
+	}
+	for _, test := range tests {
+		n, err := WaveformNumber(test.slot, test.base)
+		if test.err {
+			if err == nil {
+				t.Errorf("slot %d base %d: expected error", test.slot, test.base)
+			}
+		} else if err != nil || n != test.n {
+			t.Errorf("slot %d base %d: got %d, %v, want %d", test.slot, test.base, n, err, test.n)
+		}
+	}
+}
+
+func TestParseSlot(t *testing.T) {
+	tests := []struct {
+		in   string
+		slot int
+		err  bool
+	}{
+		{"0", 0, false},
+		{"10", 10, false},
+		{"0x10", 16, false},
+		{"0X7f", 127, false},
+		{"010", 0, true},
+		{"00", 0, true},
+		{"0x", 0, true},
+		{"0xg", 0, true},
+		{"abc", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		slot, err := ParseSlot(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error", test.in)
+			}
+		} else if err != nil || slot != test.slot {
+			t.Errorf("%q: got %d, %v, want %d", test.in, slot, err, test.slot)
+		}
+	}
+}
+
+func TestSlotFromName(t *testing.T) {
+	tests := []struct {
+		file string
+		slot int
+		ok   bool
+	}{
+		{"012-saw.wav", 12, true},
+		{"dir/7.wav", 7, true},
+		{"42dir/saw.wav", 0, false},
+		{"saw01.wav", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		slot, ok := SlotFromName(test.file)
+		if slot != test.slot || ok != test.ok {
+			t.Errorf("%q: got %d, %t, want %d, %t", test.file, slot, ok, test.slot, test.ok)
+		}
+	}
+}
+
+func TestParseSysex(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []byte
+	}{
+		{"gm-reset", []byte{0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7}},
+		{"F04310F7", []byte{0xF0, 0x43, 0x10, 0xF7}},
+		{"f0 43 10 f7", []byte{0xF0, 0x43, 0x10, 0xF7}},
+		{"", nil},
+		{"F043", nil},
+		{"F0 80 F7", nil},
+		{"F0 4 F7", nil},
+	}
+	for _, test := range tests {
+		msg, err := ParseSysex(test.in)
+		if test.out == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", test.in)
+			}
+		} else if err != nil || !bytes.Equal(msg, test.out) {
+			t.Errorf("%q: got %x, %v, want %x", test.in, msg, err, test.out)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+//go:build integration
+
+package cmdutil
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/sds"
+)
+
+// TestLoopbackTransfer performs a complete transfer through a MIDI loopback port,
+// e.g. ALSA's "Midi Through". Set SDS_LOOPBACK_DEVICE to the name of the port
+// and run with
+//
+//	go test -tags integration ./internal/cmdutil
+func TestLoopbackTransfer(t *testing.T) {
+	device := os.Getenv("SDS_LOOPBACK_DEVICE")
+	if device == "" {
+		t.Skip("SDS_LOOPBACK_DEVICE not set")
+	}
+	cfg := &Config{InDevice: device, UniversalOnly: true}
+	sender, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	samples := make([]int, 10000)
+	for i := range samples {
+		samples[i] = (i*97)%65536 - 32768
+	}
+	header := &sds.DumpHeader{Channel: 5, BitDepth: 16, Period: 22675, LoopType: sds.LoopNone}
+	send := sds.NewSendOp(samples, header)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	result := make(chan []int, 1)
+	go func() {
+		result <- receive(ctx, t, receiver)
+	}()
+
+	if err := sender.Send(header); err != nil {
+		t.Fatal(err)
+	}
+	awaitAck(ctx, t, sender, 0)
+	for !send.Done() {
+		p := send.NextMessage().(*sds.DataPacket)
+		if err := sender.Send(p); err != nil {
+			t.Fatal(err)
+		}
+		awaitAck(ctx, t, sender, p.PacketNumber)
+	}
+
+	received := <-result
+	if len(received) != len(samples) {
+		t.Fatalf("received %d samples, want %d", len(received), len(samples))
+	}
+	for i := range samples {
+		if received[i] != samples[i] {
+			t.Fatalf("sample %d mismatch: %d != %d", i, received[i], samples[i])
+		}
+	}
+}
+
+// receive runs the receiving side of the transfer.
+func receive(ctx context.Context, t *testing.T, c *Conn) []int {
+	var op *sds.ReceiveOp
+	for op == nil || !op.Done() {
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Error("receiver:", err)
+			return nil
+		}
+		switch msg := msg.(type) {
+		case *sds.DumpHeader:
+			op = sds.NewReceiveOp(msg)
+			c.Send(sds.NewAck(msg.Channel, 0))
+		case *sds.DataPacket:
+			if op != nil {
+				c.Send(op.HandlePacket(msg))
+			}
+		}
+	}
+	return op.Samples()
+}
+
+// awaitAck waits for the receiver to acknowledge a packet. Since the loopback
+// port also delivers the sender's own messages, everything else is ignored.
+func awaitAck(ctx context.Context, t *testing.T, c *Conn, packet byte) {
+	for {
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatalf("waiting for ACK of packet %d: %v", packet, err)
+		}
+		if cp, ok := msg.(*sds.ControlPacket); ok {
+			if cp.Type == sds.Ack && cp.PacketNumber == packet {
+				return
+			}
+			if cp.Type != sds.Ack {
+				t.Fatalf("unexpected response %+v", cp)
+			}
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package cmdutil
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fjl/sds/sds"
 	"gitlab.com/gomidi/midi"
 	driver "gitlab.com/gomidi/rtmididrv"
 )
@@ -12,14 +18,76 @@ import (
 type Config struct {
 	OutDevice string
 	InDevice  string
+
+	// If ExactMatch is set, InDevice must be the exact name of the device.
+	// Otherwise, the first device whose name contains InDevice is used.
+	ExactMatch bool
+
+	// If FilterChannel is set, SDS messages for channels other than Channel are
+	// not forwarded to PacketCh. The filter is disabled when Channel is
+	// sds.BroadcastChannel, because devices respond to it on their own channel.
+	FilterChannel bool
+	Channel       byte
+
+	// If UniversalOnly is set, only universal non-real-time sysex messages
+	// (starting with F0 7E) are forwarded to PacketCh. Manufacturer-specific
+	// sysex is dropped.
+	UniversalOnly bool
+
+	// MaxWriteSize limits the number of bytes passed to the MIDI driver in
+	// a single write. Longer messages are split into several writes. This is
+	// meant for USB MIDI adapters which truncate sysex messages longer than their
+	// internal buffer. No specific adapter is confirmed to need it. A DataPacket
+	// is 127 bytes long. Zero means no limit.
+	MaxWriteSize int
+
+	// If Unterminated is set, sysex messages lacking the final F7 are accepted, and
+	// decoded with sds.DecodeUnterminated. This is needed for drivers which strip
+	// the terminator or deliver it separately.
+	Unterminated bool
+
+	// If Timing is set, sysex messages are also delivered to TimedCh along with
+	// the time since the previous message. This is useful for diagnosing timing
+	// problems, e.g. whether packets are sent too quickly for a device.
+	Timing bool
+}
+
+// TimedMessage is a received sysex message with timing information.
+type TimedMessage struct {
+	Data []byte
+
+	// Delta is the time since the previous MIDI message from the input device,
+	// as reported by the driver. This includes messages that weren't delivered
+	// to PacketCh.
+	Delta time.Duration
 }
 
+// Conn is a MIDI connection.
+//
+// PacketCh and TimedCh are never closed. Consumers should select on CloseCh to
+// detect that the connection was closed.
 type Conn struct {
-	PacketCh chan []byte   // receives all sysex messages
-	CloseCh  chan struct{} // closed by Close
+	PacketCh chan []byte       // receives all sysex messages
+	TimedCh  chan TimedMessage // receives sysex messages if Config.Timing is set
+	CloseCh  chan struct{}     // closed by Close and Shutdown
 
 	in  midi.In
 	out midi.Out
+
+	filterChannel bool
+	channel       byte
+	universalOnly bool
+	unterminated  bool
+
+	maxWriteSize int
+
+	sendMu  sync.Mutex
+	sendBuf []byte
+
+	mu     sync.Mutex
+	closed bool
+
+	inflight int32 // number of running listener callbacks
 }
 
 // Open opens the MIDI connection.
@@ -30,6 +98,9 @@ func Open(cfg *Config) (*Conn, error) {
 	}
 	log.Println("midi input:", in)
 	log.Println("midi output:", out)
+	if cfg.MaxWriteSize > 0 && cfg.MaxWriteSize < maxMessageSize {
+		log.Printf("splitting sysex messages into chunks of %d bytes", cfg.MaxWriteSize)
+	}
 	if err := in.Open(); err != nil {
 		return nil, fmt.Errorf("can't open MIDI input: %v", err)
 	}
@@ -38,35 +109,166 @@ func Open(cfg *Config) (*Conn, error) {
 		return nil, fmt.Errorf("can't open MIDI output: %v", err)
 	}
 
-	var packetCh = make(chan []byte, 512)
-	in.SetListener(func(msg []byte, deltaT int64) {
-		if !isSysex(msg) {
-			return
-		}
+	return newConn(cfg, in, out), nil
+}
+
+func newConn(cfg *Config, in midi.In, out midi.Out) *Conn {
+	c := &Conn{
+		PacketCh:      make(chan []byte, 512),
+		CloseCh:       make(chan struct{}),
+		in:            in,
+		out:           out,
+		filterChannel: cfg.FilterChannel,
+		channel:       cfg.Channel,
+		universalOnly: cfg.UniversalOnly,
+		unterminated:  cfg.Unterminated,
+		maxWriteSize:  cfg.MaxWriteSize,
+	}
+	if cfg.Timing {
+		c.TimedCh = make(chan TimedMessage, 512)
+	}
+	in.SetListener(c.handleMessage)
+	return c
+}
+
+// handleMessage is the listener callback of the input device.
+func (c *Conn) handleMessage(msg []byte, deltaT int64) {
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+
+	if !isSysex(msg) && !(c.unterminated && len(msg) > 0 && msg[0] == sds.SysExStart) {
+		return
+	}
+	if c.universalOnly && !isUniversalNonRealtime(msg) {
+		return
+	}
+	if c.filterChannel && isUniversalNonRealtime(msg) && !sds.MatchChannel(c.channel, msg[2]) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.PacketCh <- msg:
+	default:
+	}
+	if c.TimedCh != nil {
 		select {
-		case packetCh <- msg:
+		case c.TimedCh <- TimedMessage{Data: msg, Delta: time.Duration(deltaT) * time.Microsecond}:
 		default:
 		}
-	})
-
-	c := &Conn{PacketCh: packetCh, CloseCh: make(chan struct{}), in: in, out: out}
-	return c, nil
+	}
 }
 
 func isSysex(msg []byte) bool {
-	return len(msg) > 0 && msg[0] == 0xf0 && msg[len(msg)-1] == 0xf7
+	return len(msg) > 0 && msg[0] == sds.SysExStart && msg[len(msg)-1] == sds.SysExEnd
 }
 
+func isUniversalNonRealtime(msg []byte) bool {
+	return len(msg) > 3 && bytes.HasPrefix(msg, sds.SysExPrefix)
+}
+
+// maxMessageSize is the size of the largest SDS message (DataPacket).
+const maxMessageSize = 127
+
+// Write sends a raw MIDI message.
 func (c *Conn) Write(msg []byte) (int, error) {
-	return c.out.Write(msg)
+	if c.maxWriteSize <= 0 {
+		return c.out.Write(msg)
+	}
+	var total int
+	for len(msg) > 0 {
+		chunk := msg
+		if len(chunk) > c.maxWriteSize {
+			chunk = chunk[:c.maxWriteSize]
+		}
+		n, err := c.out.Write(chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		msg = msg[len(chunk):]
+	}
+	return total, nil
 }
 
+// Close closes the MIDI devices. No messages are delivered to PacketCh after
+// Close has returned. It is safe to call Close multiple times.
 func (c *Conn) Close() {
+	c.mu.Lock()
+	closed := c.setClosed()
+	c.mu.Unlock()
+	if closed {
+		c.closeDevices()
+	}
+}
+
+// setClosed marks the connection as closed. It reports false if it was closed
+// already. c.mu must be held.
+func (c *Conn) setClosed() bool {
+	if c.closed {
+		return false
+	}
+	c.closed = true
 	close(c.CloseCh)
+	return true
+}
+
+func (c *Conn) closeDevices() {
+	c.in.StopListening()
 	c.in.Close()
 	c.out.Close()
 }
 
+// shutdownPollInterval is the interval at which Shutdown checks whether PacketCh
+// has been drained.
+const shutdownPollInterval = 5 * time.Millisecond
+
+// Shutdown stops listening for input, waits until the consumer has read all
+// messages buffered in PacketCh, and then closes the connection like Close.
+// Messages from listener callbacks that are still running when input is stopped
+// are delivered as well. This ensures a response that arrives at the end of a
+// transfer, such as the ACK of the final packet, isn't lost. Shutdown is only
+// useful while a consumer is still reading PacketCh.
+//
+// If ctx is done before PacketCh is drained, the connection is closed anyway and
+// Shutdown returns the context error.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	c.in.StopListening()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		// Deliveries happen under c.mu, so no message can be added to PacketCh
+		// between the check and closing.
+		c.mu.Lock()
+		if len(c.PacketCh) == 0 && atomic.LoadInt32(&c.inflight) == 0 {
+			closed := c.setClosed()
+			c.mu.Unlock()
+			if closed {
+				c.closeDevices()
+			}
+			return nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// matchDevice reports whether the device name matches the name given by the user.
+func matchDevice(name, query string, exact bool) bool {
+	if exact {
+		return name == query
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(query))
+}
+
 func findDevices(cfg *Config) (midi.In, midi.Out, error) {
 	drv, err := driver.New(driver.IgnoreActiveSense(), driver.IgnoreTimeCode())
 	if err != nil {
@@ -93,7 +295,7 @@ func findDevices(cfg *Config) (midi.In, midi.Out, error) {
 		for _, in := range inputs {
 			name := in.String()
 			inputNames = append(inputNames, name)
-			if strings.Contains(strings.ToLower(name), strings.ToLower(cfg.InDevice)) {
+			if matchDevice(name, cfg.InDevice, cfg.ExactMatch) {
 				selectedIn = in
 				break
 			}
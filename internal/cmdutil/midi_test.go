@@ -0,0 +1,308 @@
+package cmdutil
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/sds"
+	"gitlab.com/gomidi/midi"
+)
+
+type fakePort struct {
+	mu       sync.Mutex
+	open     bool
+	listener func([]byte, int64)
+	written  [][]byte
+	onStop   func() // called by StopListening
+}
+
+func (p *fakePort) Open() error             { p.mu.Lock(); p.open = true; p.mu.Unlock(); return nil }
+func (p *fakePort) Close() error            { p.mu.Lock(); p.open = false; p.mu.Unlock(); return nil }
+func (p *fakePort) IsOpen() bool            { p.mu.Lock(); defer p.mu.Unlock(); return p.open }
+func (p *fakePort) Number() int             { return 0 }
+func (p *fakePort) String() string          { return "fake" }
+func (p *fakePort) Underlying() interface{} { return nil }
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written = append(p.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (p *fakePort) SetListener(fn func([]byte, int64)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listener = fn
+	return nil
+}
+
+func (p *fakePort) StopListening() error {
+	p.mu.Lock()
+	p.listener = nil
+	onStop := p.onStop
+	p.mu.Unlock()
+	if onStop != nil {
+		onStop()
+	}
+	return nil
+}
+
+// deliver simulates the driver invoking the callback. Like real drivers, it
+// may still be running a callback while StopListening is called.
+func (p *fakePort) deliver(msg []byte) {
+	p.mu.Lock()
+	fn := p.listener
+	p.mu.Unlock()
+	if fn != nil {
+		fn(msg, 0)
+	}
+}
+
+var (
+	_ midi.In  = (*fakePort)(nil)
+	_ midi.Out = (*fakePort)(nil)
+)
+
+func TestConnCloseDuringDelivery(t *testing.T) {
+	in, out := new(fakePort), new(fakePort)
+	in.Open()
+	out.Open()
+	c := newConn(new(Config), in, out)
+	msg := []byte{0xF0, 0x7E, 0x00, 0x7F, 0x00, 0xF7}
+
+	// Deliver messages from several goroutines while closing.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					in.deliver(msg)
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			select {
+			case <-c.PacketCh:
+			case <-c.CloseCh:
+				return
+			}
+		}
+	}()
+	c.Close()
+	c.Close()
+
+	// Drain anything delivered before Close and check nothing else arrives.
+	for len(c.PacketCh) > 0 {
+		<-c.PacketCh
+	}
+	c.handleMessage(msg, 0)
+	close(stop)
+	wg.Wait()
+	if n := len(c.PacketCh); n != 0 {
+		t.Fatalf("%d messages delivered after Close", n)
+	}
+	if in.IsOpen() || out.IsOpen() {
+		t.Fatal("devices not closed")
+	}
+}
+
+func TestConnShutdown(t *testing.T) {
+	in, out := new(fakePort), new(fakePort)
+	in.Open()
+	out.Open()
+	c := newConn(new(Config), in, out)
+
+	// The ACK arrives in a callback that is still running when Shutdown stops
+	// listening. Holding c.mu delays its delivery until Shutdown has started.
+	ack := []byte{0xF0, 0x7E, 0x00, 0x7F, 0x05, 0xF7}
+	in.onStop = func() { go c.handleMessage(ack, 0) }
+	c.mu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- c.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-c.CloseCh:
+		t.Fatal("connection closed before PacketCh was drained")
+	default:
+	}
+	msg, err := c.Receive(context.Background())
+	if err != nil {
+		t.Fatal("Receive error:", err)
+	}
+	if p, ok := msg.(*sds.ControlPacket); !ok || p.Type != sds.Ack || p.PacketNumber != 5 {
+		t.Fatalf("wrong message %v", msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown error:", err)
+	}
+	if in.IsOpen() || out.IsOpen() {
+		t.Fatal("devices not closed")
+	}
+	in.deliver(ack)
+	if n := len(c.PacketCh); n != 0 {
+		t.Fatalf("%d messages delivered after Shutdown", n)
+	}
+}
+
+func TestConnShutdownTimeout(t *testing.T) {
+	in, out := new(fakePort), new(fakePort)
+	c := newConn(new(Config), in, out)
+	c.handleMessage([]byte{0xF0, 0x7E, 0x00, 0x7F, 0x00, 0xF7}, 0)
+
+	// Nobody reads PacketCh, so Shutdown gives up when the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want deadline error", err)
+	}
+	select {
+	case <-c.CloseCh:
+	default:
+		t.Fatal("connection not closed after Shutdown timeout")
+	}
+}
+
+func TestConnChannelFilter(t *testing.T) {
+	cfg := &Config{FilterChannel: true, Channel: 2}
+	c := newConn(cfg, new(fakePort), new(fakePort))
+	defer c.Close()
+
+	c.handleMessage([]byte{0xF0, 0x7E, 0x01, 0x7F, 0x00, 0xF7}, 0) // other channel
+	c.handleMessage([]byte{0xF0, 0x7E, 0x02, 0x7F, 0x01, 0xF7}, 0) // matching
+	c.handleMessage([]byte{0xF0, 0x41, 0x10, 0x42, 0xF7}, 0)       // not SDS
+	if n := len(c.PacketCh); n != 2 {
+		t.Fatalf("%d messages delivered, want 2", n)
+	}
+	if msg := <-c.PacketCh; msg[4] != 0x01 {
+		t.Fatalf("wrong message delivered: %x", msg)
+	}
+
+	// Responses to the broadcast channel come from any channel.
+	c = newConn(&Config{FilterChannel: true, Channel: sds.BroadcastChannel}, new(fakePort), new(fakePort))
+	defer c.Close()
+	c.handleMessage([]byte{0xF0, 0x7E, 0x01, 0x7F, 0x00, 0xF7}, 0)
+	if n := len(c.PacketCh); n != 1 {
+		t.Fatalf("%d messages delivered with broadcast channel, want 1", n)
+	}
+}
+
+func TestConnMaxWriteSize(t *testing.T) {
+	out := new(fakePort)
+	c := newConn(&Config{MaxWriteSize: 50}, new(fakePort), out)
+	defer c.Close()
+
+	msg := make([]byte, 127)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	n, err := c.Write(msg)
+	if err != nil || n != len(msg) {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if len(out.written) != 3 {
+		t.Fatalf("got %d writes, want 3", len(out.written))
+	}
+	var joined []byte
+	for i, w := range out.written {
+		if len(w) > 50 {
+			t.Errorf("write %d has size %d", i, len(w))
+		}
+		joined = append(joined, w...)
+	}
+	if !bytes.Equal(joined, msg) {
+		t.Fatalf("wrong data written: %x", joined)
+	}
+}
+
+func TestConnUniversalOnly(t *testing.T) {
+	c := newConn(&Config{UniversalOnly: true}, new(fakePort), new(fakePort))
+	defer c.Close()
+
+	c.handleMessage([]byte{0xF0, 0x41, 0x10, 0x42, 0xF7}, 0)       // Roland
+	c.handleMessage([]byte{0xF0, 0x7F, 0x7F, 0x04, 0x01, 0xF7}, 0) // real-time
+	c.handleMessage([]byte{0xF0, 0x7E, 0x00, 0x7F, 0x00, 0xF7}, 0) // SDS ACK
+	if n := len(c.PacketCh); n != 1 {
+		t.Fatalf("%d messages delivered, want 1", n)
+	}
+}
+
+func TestConnUnterminated(t *testing.T) {
+	ack := []byte{0xF0, 0x7E, 0x00, 0x7F, 0x03}
+
+	// By default, messages without F7 are dropped.
+	c := newConn(new(Config), new(fakePort), new(fakePort))
+	defer c.Close()
+	c.handleMessage(ack, 0)
+	if n := len(c.PacketCh); n != 0 {
+		t.Fatalf("%d unterminated messages delivered", n)
+	}
+
+	c = newConn(&Config{Unterminated: true}, new(fakePort), new(fakePort))
+	defer c.Close()
+	c.handleMessage(ack, 0)
+	c.handleMessage([]byte{0xF7}, 0) // terminator delivered on its own
+	c.handleMessage(append(ack, 0xF7), 0)
+	if n := len(c.PacketCh); n != 2 {
+		t.Fatalf("%d messages delivered, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		msg := c.ReceiveTimeout(time.Second)
+		if p, ok := msg.(*sds.ControlPacket); !ok || p.Type != sds.Ack || p.PacketNumber != 3 {
+			t.Fatalf("message %d: wrong message %v", i, msg)
+		}
+	}
+}
+
+func TestMatchDevice(t *testing.T) {
+	tests := []struct {
+		name, query string
+		exact, want bool
+	}{
+		{"MIDIFACE Port 1", "port 1", false, true},
+		{"MIDIFACE Port 10", "port 1", false, true},
+		{"MIDIFACE Port 1", "MIDIFACE Port 1", true, true},
+		{"MIDIFACE Port 10", "MIDIFACE Port 1", true, false},
+		{"MIDIFACE Port 1", "midiface port 1", true, false},
+	}
+	for _, test := range tests {
+		if got := matchDevice(test.name, test.query, test.exact); got != test.want {
+			t.Errorf("matchDevice(%q, %q, %t) = %t", test.name, test.query, test.exact, got)
+		}
+	}
+}
+
+func TestConnTiming(t *testing.T) {
+	in, out := new(fakePort), new(fakePort)
+	c := newConn(&Config{Timing: true}, in, out)
+	defer c.Close()
+	msg := []byte{0xF0, 0x7E, 0x00, 0x7F, 0x00, 0xF7}
+	c.handleMessage(msg, 1500)
+
+	if got := <-c.PacketCh; !bytes.Equal(got, msg) {
+		t.Fatalf("wrong message on PacketCh: %x", got)
+	}
+	tm := <-c.TimedCh
+	if !bytes.Equal(tm.Data, msg) || tm.Delta != 1500*time.Microsecond {
+		t.Fatalf("wrong timed message %x, delta %v", tm.Data, tm.Delta)
+	}
+
+	// Without Timing, TimedCh is nil.
+	if c := newConn(new(Config), in, out); c.TimedCh != nil {
+		t.Fatal("TimedCh created without Config.Timing")
+	}
+}
@@ -0,0 +1,56 @@
+package cmdutil
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/fjl/sds/sds"
+)
+
+// Send writes an SDS message. The encoding buffer is reused across calls.
+func (c *Conn) Send(msg sds.Message) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.sendBuf = msg.Encode(c.sendBuf[:0])
+	_, err := c.Write(c.sendBuf)
+	return err
+}
+
+var errClosed = errors.New("connection closed")
+
+var _ sds.Transport = (*Conn)(nil)
+
+// Receive waits for an SDS message. Messages that cannot be decoded are
+// logged and skipped.
+func (c *Conn) Receive(ctx context.Context) (sds.Message, error) {
+	for {
+		select {
+		case rawmsg := <-c.PacketCh:
+			decode := sds.Decode
+			if c.unterminated {
+				decode = sds.DecodeUnterminated
+			}
+			msg, err := decode(rawmsg)
+			if err != nil {
+				log.Printf("msg %x: %v", rawmsg, err)
+				continue
+			}
+			return msg, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.CloseCh:
+			return nil, errClosed
+		}
+	}
+}
+
+// ReceiveTimeout waits for an SDS message. It returns nil if no message arrives
+// within the timeout.
+func (c *Conn) ReceiveTimeout(timeout time.Duration) sds.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	msg, _ := c.Receive(ctx)
+	return msg
+}
@@ -0,0 +1,55 @@
+package cmdutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/sds"
+)
+
+func TestConnReceive(t *testing.T) {
+	c := newConn(new(Config), new(fakePort), new(fakePort))
+	defer c.Close()
+
+	c.handleMessage(sds.NewAck(1, 2).Encode(nil), 0)
+	msg, err := c.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp, ok := msg.(*sds.ControlPacket); !ok || *cp != *sds.NewAck(1, 2) {
+		t.Fatalf("wrong message %#v", msg)
+	}
+
+	// Cancellation is reported as an error.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Receive(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wrong error %v", err)
+	}
+	if msg := c.ReceiveTimeout(10 * time.Millisecond); msg != nil {
+		t.Fatalf("ReceiveTimeout returned %#v", msg)
+	}
+}
+
+func TestConnReceiveClosed(t *testing.T) {
+	c := newConn(new(Config), new(fakePort), new(fakePort))
+	c.Close()
+	if _, err := c.Receive(context.Background()); err != errClosed {
+		t.Fatalf("wrong error %v", err)
+	}
+}
+
+func BenchmarkConnSend(b *testing.B) {
+	c := newConn(new(Config), new(fakePort), new(fakePort))
+	defer c.Close()
+	msg := &sds.DataPacket{Channel: 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Package sdstest provides a fake SDS device for tests.
+//
+// The package doesn't import package sds, so the tests of package sds can use it
+// as well. Receiver is instantiated with sds.Message as the message type.
+package sdstest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Receiver is a fake device. Receiver[sds.Message] implements sds.Transport.
+type Receiver[M any] struct {
+	handle func(*Receiver[M], M)
+
+	mu       sync.Mutex
+	received []M
+	ch       chan M
+}
+
+// NewReceiver creates a fake device. handle is called for every message sent to the
+// device. It may call Respond to send messages back.
+func NewReceiver[M any](handle func(*Receiver[M], M)) *Receiver[M] {
+	return &Receiver[M]{handle: handle, ch: make(chan M, 100)}
+}
+
+// Send delivers msg to the device.
+func (r *Receiver[M]) Send(msg M) error {
+	r.mu.Lock()
+	r.received = append(r.received, msg)
+	r.mu.Unlock()
+	r.handle(r, msg)
+	return nil
+}
+
+// Receive waits for a response of the device.
+func (r *Receiver[M]) Receive(ctx context.Context) (M, error) {
+	select {
+	case msg := <-r.ch:
+		return msg, nil
+	case <-ctx.Done():
+		var zero M
+		return zero, ctx.Err()
+	}
+}
+
+// Respond delivers msg to the sender after the given delay.
+func (r *Receiver[M]) Respond(msg M, delay time.Duration) {
+	if delay == 0 {
+		r.ch <- msg
+		return
+	}
+	time.AfterFunc(delay, func() { r.ch <- msg })
+}
+
+// Received returns the messages sent to the device.
+func (r *Receiver[M]) Received() []M {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]M(nil), r.received...)
+}
@@ -0,0 +1,134 @@
+package sds
+
+import "time"
+
+// TransferConfig configures SendOp.Run and ReceiveDump.
+//
+// Use NewTransferConfig to create a configuration with the default settings. Zero
+// durations and counts in a TransferConfig also select the defaults, so the zero
+// value is usable as well.
+type TransferConfig struct {
+	// Channel and Number select the waveform received by ReceiveDump. Run takes
+	// them from the DumpHeader of the SendOp instead.
+	Channel byte
+	Number  uint16
+
+	// Request makes ReceiveDump send a DumpRequest for waveform Number. When
+	// false, ReceiveDump waits for the sender to start a dump.
+	Request bool
+
+	// AnyChannel makes ReceiveDump accept a DumpHeader on any channel. The
+	// transfer then locks onto the channel of that header. This helps when the
+	// SDS channel configured on the device is unknown.
+	AnyChannel bool
+
+	// Probe enables detection of handshaking support before the transfer. The
+	// receiver is sent a DumpRequest, and is considered to be handshaking if
+	// it responds.
+	Probe bool
+
+	// HeaderRetries is the number of times the DumpHeader is resent when the
+	// receiver doesn't respond to it.
+	HeaderRetries int
+
+	// NakRetries is the number of times a data packet is resent when the receiver
+	// responds with NAK. When the same packet is rejected more often, the transfer
+	// is cancelled and Run returns a *NakError. Zero selects the default of 3. Set
+	// it to NoRetries to cancel on the first NAK.
+	NakRetries int
+
+	// Confirm makes Run wait for the receiver to acknowledge the final packet.
+	Confirm bool
+
+	// ResumeFrom is the index of the first packet to send. When set, the
+	// header is not sent because the receiver is assumed to hold the earlier
+	// packets already.
+	ResumeFrom int
+
+	// PacketDelay is the time between data packets when the receiver is
+	// non-handshaking. The default is 20ms.
+	PacketDelay time.Duration
+
+	// FirstPacketDelay is a pause between the acknowledgement of the header and
+	// the first data packet. It applies only when the receiver ACKs the header.
+	// It is meant for devices that need time to prepare the slot after the ACK,
+	// but no specific device is known to need it. The default is zero.
+	FirstPacketDelay time.Duration
+
+	// HandshakeTimeout is the time to wait for a response to the DumpHeader or a
+	// DumpRequest. Receivers that don't respond in time are treated as
+	// non-handshaking. The default is 2s.
+	HandshakeTimeout time.Duration
+
+	// HeaderRetryTimeout replaces HandshakeTimeout while header retries remain.
+	// The default is 500ms.
+	HeaderRetryTimeout time.Duration
+
+	// HeaderWaitTimeout is the maximum time Run waits for the receiver to follow up
+	// on a WAIT response to the header. It counts from the first WAIT, further
+	// WAITs don't extend it. The default is 10s.
+	HeaderWaitTimeout time.Duration
+
+	// AckTimeout is the time to wait for the acknowledgement of a data packet when
+	// the receiver is handshaking. The default is 20ms.
+	AckTimeout time.Duration
+
+	// ConfirmTimeout is the time to wait for the acknowledgement of the final
+	// packet when Confirm is set. The default is 2s.
+	ConfirmTimeout time.Duration
+
+	// PacketTimeout is the time ReceiveDump waits for the next valid data packet.
+	// Rejected and duplicate packets don't extend it, so a sender that keeps
+	// sending bad packets can't stall the receiver. The default is 2s.
+	PacketTimeout time.Duration
+
+	// Loops contains additional loops of the waveform, e.g. a release loop. They
+	// are sent as LoopPoint messages after the waveform data. The Channel and
+	// Number fields are set from the DumpHeader.
+	Loops []LoopPoint
+
+	// OnProgress is called by Run after each data packet with the number of packets
+	// sent so far and the total number of packets. When set, Run doesn't log the
+	// progress.
+	OnProgress func(sent, total int)
+
+	// Log receives diagnostic messages. It may be nil.
+	Log func(format string, args ...interface{})
+}
+
+// NoRetries disables resending when used as TransferConfig.NakRetries.
+const NoRetries = -1
+
+// NewTransferConfig returns a configuration with the default settings.
+func NewTransferConfig() *TransferConfig {
+	cfg := new(TransferConfig).withDefaults()
+	return &cfg
+}
+
+// withDefaults returns a copy of cfg with the defaults applied.
+func (cfg *TransferConfig) withDefaults() TransferConfig {
+	c := *cfg
+	setDefault(&c.PacketDelay, 20*time.Millisecond)
+	setDefault(&c.HandshakeTimeout, 2*time.Second)
+	setDefault(&c.HeaderRetryTimeout, 500*time.Millisecond)
+	setDefault(&c.HeaderWaitTimeout, 10*time.Second)
+	setDefault(&c.AckTimeout, 20*time.Millisecond)
+	setDefault(&c.ConfirmTimeout, 2*time.Second)
+	setDefault(&c.PacketTimeout, 2*time.Second)
+	if c.NakRetries == 0 {
+		c.NakRetries = 3
+	}
+	return c
+}
+
+func setDefault(d *time.Duration, def time.Duration) {
+	if *d == 0 {
+		*d = def
+	}
+}
+
+func (cfg *TransferConfig) logf(format string, args ...interface{}) {
+	if cfg.Log != nil {
+		cfg.Log(format, args...)
+	}
+}
@@ -0,0 +1,190 @@
+package sds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/go-audio/wav"
+)
+
+// CueLoop derives a loop from the cue points of the WAV file in r. This is meant as
+// a fallback for files without a smpl chunk, which some editors produce when they
+// store loops as markers. The loop is taken from, in order of preference:
+//
+//   - a playlist (plst) segment that is played more than once
+//   - a labeled region, i.e. a cue point with an adtl ltxt chunk giving its length
+//   - a pair of cue points, if the file has exactly two. The loop ends just before
+//     the second cue.
+//
+// Cue positions are read from the sample offset field, which holds the sample frame
+// in files without a wave list. The returned loop is a forward loop. CueLoop returns
+// nil if no loop can be derived. r is read from the start.
+func CueLoop(r io.ReadSeeker) (*wav.SampleLoop, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cues, err := readCueChunks(r)
+	if err != nil {
+		return nil, err
+	}
+	// Playlist segments that repeat.
+	for _, seg := range cues.playlist {
+		if pos, ok := cues.offsets[seg.id]; ok && seg.repeats > 1 && seg.length > 0 {
+			return &wav.SampleLoop{Type: wavLoopForward, Start: pos, End: pos + seg.length - 1}, nil
+		}
+	}
+	// Labeled regions.
+	for _, id := range cues.order {
+		if length := cues.regions[id]; length > 0 {
+			pos := cues.offsets[id]
+			return &wav.SampleLoop{Type: wavLoopForward, Start: pos, End: pos + length - 1}, nil
+		}
+	}
+	// Two markers.
+	if len(cues.order) == 2 {
+		a, b := cues.offsets[cues.order[0]], cues.offsets[cues.order[1]]
+		if a > b {
+			a, b = b, a
+		}
+		if a < b {
+			return &wav.SampleLoop{Type: wavLoopForward, Start: a, End: b - 1}, nil
+		}
+	}
+	return nil, nil
+}
+
+// wavCues holds the cue-related chunks of a WAV file.
+type wavCues struct {
+	order    []uint32          // cue IDs sorted by position
+	offsets  map[uint32]uint32 // sample position of each cue
+	regions  map[uint32]uint32 // region length from ltxt chunks
+	playlist []playlistSegment
+}
+
+type playlistSegment struct {
+	id, length, repeats uint32
+}
+
+var errNotWAV = errors.New("not a RIFF WAVE file")
+
+// maxCueChunkSize limits the size of chunks read by readCueChunks. Larger chunks
+// are skipped.
+const maxCueChunkSize = 1 << 20
+
+// readCueChunks reads the cue, plst and LIST/adtl chunks of a WAV file.
+func readCueChunks(r io.Reader) (*wavCues, error) {
+	cues := &wavCues{offsets: make(map[uint32]uint32), regions: make(map[uint32]uint32)}
+	err := walkChunks(r, func(id string, size uint32, r io.Reader) error {
+		if (id != "cue " && id != "plst" && id != "LIST") || size > maxCueChunkSize {
+			return nil
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("can't read %q chunk: %v", id, err)
+		}
+		return cues.decode(id, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cues, nil
+}
+
+// walkChunks calls fn for each chunk of the RIFF WAVE file in r. fn can read the body
+// of the chunk from the reader it is given, the remainder is skipped. Walking stops
+// at the end of the file, or when fn returns an error. A truncated chunk at the end
+// of the file is not an error.
+func walkChunks(r io.Reader, fn func(id string, size uint32, body io.Reader) error) error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return errNotWAV
+	}
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		id, size := string(ch[:4]), binary.LittleEndian.Uint32(ch[4:])
+		body := io.LimitReader(r, int64(size))
+		if err := fn(id, size, body); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		if body.(*io.LimitedReader).N > 0 {
+			return nil // truncated file
+		}
+		if size%2 == 1 {
+			io.CopyN(io.Discard, r, 1) // chunks are aligned to even offsets
+		}
+	}
+}
+
+func (c *wavCues) decode(id string, body []byte) error {
+	switch id {
+	case "cue ":
+		if len(body) < 4 {
+			return errors.New("short cue chunk")
+		}
+		n := binary.LittleEndian.Uint32(body)
+		body = body[4:]
+		if uint64(len(body)) < uint64(n)*24 {
+			return errors.New("short cue chunk")
+		}
+		for i := uint32(0); i < n; i++ {
+			e := body[i*24 : i*24+24]
+			cueID := binary.LittleEndian.Uint32(e)
+			c.order = append(c.order, cueID)
+			c.offsets[cueID] = binary.LittleEndian.Uint32(e[20:])
+		}
+		sort.SliceStable(c.order, func(i, j int) bool {
+			return c.offsets[c.order[i]] < c.offsets[c.order[j]]
+		})
+	case "plst":
+		if len(body) < 4 {
+			return errors.New("short plst chunk")
+		}
+		n := binary.LittleEndian.Uint32(body)
+		body = body[4:]
+		if uint64(len(body)) < uint64(n)*12 {
+			return errors.New("short plst chunk")
+		}
+		for i := uint32(0); i < n; i++ {
+			e := body[i*12 : i*12+12]
+			c.playlist = append(c.playlist, playlistSegment{
+				id:      binary.LittleEndian.Uint32(e),
+				length:  binary.LittleEndian.Uint32(e[4:]),
+				repeats: binary.LittleEndian.Uint32(e[8:]),
+			})
+		}
+	case "LIST":
+		if !bytes.HasPrefix(body, []byte("adtl")) {
+			return nil
+		}
+		for sub := body[4:]; len(sub) >= 8; {
+			subID, size := string(sub[:4]), binary.LittleEndian.Uint32(sub[4:])
+			sub = sub[8:]
+			if uint64(size) > uint64(len(sub)) {
+				break
+			}
+			if subID == "ltxt" && size >= 8 {
+				c.regions[binary.LittleEndian.Uint32(sub)] = binary.LittleEndian.Uint32(sub[4:])
+			}
+			if size%2 == 1 && size < uint32(len(sub)) {
+				size++
+			}
+			sub = sub[size:]
+		}
+	}
+	return nil
+}
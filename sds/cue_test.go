@@ -0,0 +1,93 @@
+package sds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+func TestCueLoop(t *testing.T) {
+	cue := func(id, pos uint32) []uint32 {
+		return []uint32{id, pos, 0x61746164, 0, 0, pos} // data chunk
+	}
+	cueChunk := func(cues ...[]uint32) []byte {
+		body := appendUint32LE(nil, uint32(len(cues)))
+		for _, c := range cues {
+			for _, v := range c {
+				body = appendUint32LE(body, v)
+			}
+		}
+		return body
+	}
+	ltxt := func(id, length uint32) []byte {
+		body := []byte("adtlltxt")
+		body = appendUint32LE(body, 20)
+		body = appendUint32LE(body, id)
+		body = appendUint32LE(body, length)
+		body = append(body, "rgn "...)
+		return append(body, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+	plst := appendUint32LE(nil, 1)
+	plst = appendUint32LE(plst, 2)
+	plst = appendUint32LE(plst, 30)
+	plst = appendUint32LE(plst, 4)
+
+	type chunk struct {
+		id   string
+		body []byte
+	}
+	tests := []struct {
+		name   string
+		chunks []chunk
+		want   *wav.SampleLoop
+	}{
+		{"none", nil, nil},
+		{"markers", []chunk{{"cue ", cueChunk(cue(1, 60), cue(2, 20))}}, &wav.SampleLoop{Start: 20, End: 59}},
+		{"three markers", []chunk{{"cue ", cueChunk(cue(1, 10), cue(2, 20), cue(3, 30))}}, nil},
+		{"region", []chunk{
+			{"cue ", cueChunk(cue(1, 10), cue(2, 20), cue(3, 30))},
+			{"LIST", ltxt(2, 50)},
+		}, &wav.SampleLoop{Start: 20, End: 69}},
+		{"playlist", []chunk{
+			{"cue ", cueChunk(cue(1, 10), cue(2, 40))},
+			{"LIST", ltxt(1, 5)},
+			{"plst", plst},
+		}, &wav.SampleLoop{Start: 40, End: 69}},
+	}
+	for _, test := range tests {
+		file := filepath.Join(t.TempDir(), "cue.wav")
+		fd, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := wav.NewEncoder(fd, 44100, 16, 1, 1)
+		buf := &audio.IntBuffer{Data: testWaveform(100), Format: &audio.Format{NumChannels: 1, SampleRate: 44100}, SourceBitDepth: 16}
+		if err := enc.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range test.chunks {
+			if err := appendChunk(fd, c.id, c.body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		loop, err := CueLoop(fd)
+		fd.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		switch {
+		case test.want == nil && loop != nil:
+			t.Errorf("%s: got loop %+v, want none", test.name, *loop)
+		case test.want != nil && loop == nil:
+			t.Errorf("%s: no loop, want %+v", test.name, *test.want)
+		case test.want != nil && *loop != *test.want:
+			t.Errorf("%s: got loop %+v, want %+v", test.name, *loop, *test.want)
+		}
+	}
+}
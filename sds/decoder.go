@@ -0,0 +1,205 @@
+package sds
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Decoder reads SDS messages from a byte stream, such as a .sds or .syx file.
+type Decoder struct {
+	// TolerateChecksumErrors makes the decoder return DataPackets with a checksum
+	// mismatch instead of failing. Such packets are recorded and can be retrieved
+	// using BadPackets.
+	TolerateChecksumErrors bool
+
+	// HighBitPolicy sets the handling of DataPackets containing data bytes with
+	// the high bit set. The default is HighBitMask.
+	HighBitPolicy HighBitPolicy
+
+	r           *bufio.Reader
+	pos         int64 // number of bytes consumed from r
+	start, end  int64 // offsets of the last message
+	packetIndex int
+	bad         []BadPacket
+}
+
+// HighBitPolicy is the handling of invalid data bytes by Decoder.
+//
+// Valid SDS messages never contain data bytes with the high bit set. Such bytes are
+// caused by transmission errors, so HighBitReject is the safe choice when capturing
+// a live transfer. HighBitMask can be used to recover what is left of legacy dumps
+// captured with faulty equipment.
+type HighBitPolicy int
+
+const (
+	HighBitMask   HighBitPolicy = iota // clear the high bit of all data bytes
+	HighBitReject                      // skip the packet and record it in BadPackets
+	HighBitError                       // fail with an error wrapping ErrHighBit
+)
+
+// BadPacket describes a DataPacket that failed validation.
+type BadPacket struct {
+	Index        int  // index of the packet in the dump, counting from zero
+	PacketNumber byte // packet number as transmitted
+	Rejected     bool // packet was skipped due to HighBitReject
+}
+
+// NewDecoder creates a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// ReadMessage reads the next message from the input. It returns io.EOF when
+// the input is exhausted.
+//
+// Bytes between messages are skipped. When a message is not terminated before the
+// start of the next one, the unterminated part is discarded.
+func (d *Decoder) ReadMessage() (Message, error) {
+	for {
+		msg, err := d.readMessage()
+		if err != errRejected {
+			return msg, err
+		}
+	}
+}
+
+var errRejected = errors.New("packet rejected")
+
+func (d *Decoder) readMessage() (Message, error) {
+	rawmsg, err := d.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := Decode(rawmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := msg.(type) {
+	case *DumpHeader:
+		d.packetIndex = 0
+	case *DataPacket:
+		index := d.packetIndex
+		d.packetIndex++
+		if !msg.Valid7Bit() {
+			switch d.HighBitPolicy {
+			case HighBitMask:
+				for i := range msg.Data {
+					msg.Data[i] &= 0x7F
+				}
+			case HighBitReject:
+				d.bad = append(d.bad, BadPacket{Index: index, PacketNumber: msg.PacketNumber, Rejected: true})
+				return nil, errRejected
+			case HighBitError:
+				return nil, fmt.Errorf("%w in packet %d", ErrHighBit, msg.PacketNumber)
+			}
+		}
+		if sum := msg.ComputeChecksum(); sum != msg.Checksum {
+			if !d.TolerateChecksumErrors {
+				return nil, &ChecksumError{Packet: msg.PacketNumber, Got: msg.Checksum, Want: sum}
+			}
+			d.bad = append(d.bad, BadPacket{Index: index, PacketNumber: msg.PacketNumber})
+		}
+	}
+	return msg, nil
+}
+
+// Offset returns the byte offsets of the last message read by ReadMessage. The
+// message occupies the input bytes from start up to, but not including, end. This is
+// also set when ReadMessage fails to decode a message.
+func (d *Decoder) Offset() (start, end int64) {
+	return d.start, d.end
+}
+
+// readFrame reads the next sysex message from the input.
+func (d *Decoder) readFrame() ([]byte, error) {
+	// Skip to the start of the message.
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == SysExStart {
+			d.r.UnreadByte()
+			break
+		}
+		d.pos++
+	}
+	frame, err := d.r.ReadBytes(SysExEnd)
+	d.pos += int64(len(frame))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	// Resynchronize if another message started within the frame.
+	if i := bytes.LastIndexByte(frame, SysExStart); i > 0 {
+		frame = frame[i:]
+	}
+	d.start, d.end = d.pos-int64(len(frame)), d.pos
+	return frame, nil
+}
+
+// BadPackets returns the DataPackets which had a checksum mismatch or were rejected.
+// This is only relevant when TolerateChecksumErrors or HighBitReject is set.
+func (d *Decoder) BadPackets() []BadPacket {
+	return d.bad
+}
+
+// SampleReader reads the waveform data of a dump from a Decoder.
+type SampleReader struct {
+	dec       *Decoder
+	header    *DumpHeader
+	remaining uint
+	buf       []int
+}
+
+// NewSampleReader creates a sample reader.
+func NewSampleReader(dec *Decoder) *SampleReader {
+	return &SampleReader{dec: dec}
+}
+
+// Header returns the DumpHeader of the dump, reading it from the input if necessary.
+func (r *SampleReader) Header() (*DumpHeader, error) {
+	for r.header == nil {
+		msg, err := r.dec.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if h, ok := msg.(*DumpHeader); ok {
+			r.header = h
+			r.remaining = h.Length
+		}
+	}
+	return r.header, nil
+}
+
+// ReadSamples returns the samples contained in the next DataPacket. Padding in the
+// final packet is removed. The returned slice is only valid until the next call to
+// ReadSamples. When all samples have been read, it returns io.EOF.
+func (r *SampleReader) ReadSamples() ([]int, error) {
+	h, err := r.Header()
+	if err != nil {
+		return nil, err
+	}
+	for r.remaining > 0 {
+		msg, err := r.dec.ReadMessage()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			return nil, fmt.Errorf("unexpected DumpHeader with %d samples remaining", r.remaining)
+		case *DataPacket:
+			r.buf = msg.GetSamplesN(r.buf[:0], int(h.BitDepth), int(r.remaining))
+			r.remaining -= uint(len(r.buf))
+			return r.buf, nil
+		}
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,214 @@
+package sds
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDecoderChecksumErrors(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/akwf1_16bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt a data byte in the third packet.
+	raw[dumpHeaderSize+2*dataPacketSize+10] ^= 0x01
+
+	// Strict mode must reject the packet.
+	dec := NewDecoder(bytes.NewReader(raw))
+	for {
+		_, err = dec.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("strict decoder returned error %v, want checksum error", err)
+	}
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) || cerr.Packet != 2 || cerr.Got == cerr.Want {
+		t.Fatalf("wrong checksum error %#v", err)
+	}
+	wantStart := int64(dumpHeaderSize + 2*dataPacketSize)
+	if start, end := dec.Offset(); start != wantStart || end != wantStart+dataPacketSize {
+		t.Errorf("wrong offset %d-%d for bad packet", start, end)
+	}
+
+	// Tolerant mode returns all packets and records the bad one.
+	dec = NewDecoder(bytes.NewReader(raw))
+	dec.TolerateChecksumErrors = true
+	var packets int
+	for {
+		msg, err := dec.ReadMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("tolerant decoder error:", err)
+		}
+		if _, ok := msg.(*DataPacket); ok {
+			packets++
+		}
+	}
+	if packets != 15 {
+		t.Errorf("decoded %d packets, want 15", packets)
+	}
+	want := []BadPacket{{Index: 2, PacketNumber: 2}}
+	if bad := dec.BadPackets(); !reflect.DeepEqual(bad, want) {
+		t.Errorf("wrong bad packets %v, want %v", bad, want)
+	}
+}
+
+func TestDecoderHighBit(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/akwf1_16bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decodeAll(t, raw)
+	// Set the high bit of a data byte in the second packet.
+	raw[dumpHeaderSize+dataPacketSize+20] |= 0x80
+
+	// HighBitError fails at the bad packet.
+	dec := NewDecoder(bytes.NewReader(raw))
+	dec.HighBitPolicy = HighBitError
+	for {
+		_, err = dec.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrHighBit) {
+		t.Fatalf("decoder returned error %v, want high bit error", err)
+	}
+	wantStart := int64(dumpHeaderSize + dataPacketSize)
+	if start, _ := dec.Offset(); start != wantStart {
+		t.Errorf("wrong offset %d for bad packet, want %d", start, wantStart)
+	}
+
+	// HighBitMask clears the bit.
+	if got := decodeAll(t, raw); !reflect.DeepEqual(got, want) {
+		t.Error("masked packets differ from original")
+	}
+
+	// HighBitReject skips the packet.
+	dec = NewDecoder(bytes.NewReader(raw))
+	dec.HighBitPolicy = HighBitReject
+	var numbers []byte
+	for {
+		msg, err := dec.ReadMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := msg.(*DataPacket); ok {
+			numbers = append(numbers, p.PacketNumber)
+		}
+	}
+	if len(numbers) != 14 || numbers[0] != 0 || numbers[1] != 2 {
+		t.Errorf("wrong packets %d", numbers)
+	}
+	wantBad := []BadPacket{{Index: 1, PacketNumber: 1, Rejected: true}}
+	if bad := dec.BadPackets(); !reflect.DeepEqual(bad, wantBad) {
+		t.Errorf("wrong bad packets %v, want %v", bad, wantBad)
+	}
+
+	// Decode keeps the byte.
+	msg, err := Decode(raw[wantStart : wantStart+dataPacketSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*DataPacket).Valid7Bit() {
+		t.Error("Valid7Bit returned true for corrupt packet")
+	}
+}
+
+func TestDecoderResync(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/akwf1_16bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decodeAll(t, raw)
+
+	// Insert garbage after the header, and an unterminated message before
+	// the second packet.
+	var corrupt []byte
+	corrupt = append(corrupt, raw[:dumpHeaderSize]...)
+	corrupt = append(corrupt, 0x01, 0x02, SysExEnd, 0x03)
+	corrupt = append(corrupt, raw[dumpHeaderSize:dumpHeaderSize+dataPacketSize]...)
+	corrupt = append(corrupt, SysExStart, UniversalNonRealtime, 0x00, 0x02, 0x11)
+	corrupt = append(corrupt, raw[dumpHeaderSize+dataPacketSize:]...)
+	corrupt = append(corrupt, 0x55)
+
+	if got := decodeAll(t, corrupt); !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %d messages, want %d", len(got), len(want))
+	}
+
+	// Check offsets of the messages around the garbage.
+	dec := NewDecoder(bytes.NewReader(corrupt))
+	offsets := [][2]int64{
+		{0, dumpHeaderSize},
+		{dumpHeaderSize + 4, dumpHeaderSize + 4 + dataPacketSize},
+		{dumpHeaderSize + 9 + dataPacketSize, dumpHeaderSize + 9 + 2*dataPacketSize},
+	}
+	for i, want := range offsets {
+		if _, err := dec.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		if start, end := dec.Offset(); start != want[0] || end != want[1] {
+			t.Errorf("message %d: offset %d-%d, want %d-%d", i, start, end, want[0], want[1])
+		}
+	}
+}
+
+func decodeAll(t *testing.T, raw []byte) []Message {
+	t.Helper()
+	var msgs []Message
+	dec := NewDecoder(bytes.NewReader(raw))
+	for {
+		msg, err := dec.ReadMessage()
+		if err == io.EOF {
+			return msgs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestSampleReader(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/akwf1_24bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wavFile, err := loadWAV("testdata/akwf1_24bit_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSampleReader(NewDecoder(bytes.NewReader(raw)))
+	h, err := r.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.BitDepth != 24 {
+		t.Fatalf("wrong bit depth %d", h.BitDepth)
+	}
+	var samples []int
+	for {
+		block, err := r.ReadSamples()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, block...)
+	}
+	if !samplesEqual(samples, wavFile.samples) {
+		t.Error("samples not equal")
+		t.Logf("wav (%d) %8d", len(wavFile.samples), wavFile.samples)
+		t.Logf("sds (%d) %8d", len(samples), samples)
+	}
+}
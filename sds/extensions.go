@@ -0,0 +1,149 @@
+package sds
+
+import "fmt"
+
+// This file implements the loop point messages of the Sample Dump Standard
+// extensions. They allow devices to store multiple loops per waveform, which are
+// addressed by number. The loop in the DumpHeader is loop number zero.
+//
+// The extended DumpHeader defined alongside them is decoded into a DumpHeader as
+// well, see decodeExtendedDumpHeader.
+
+// LoopPoint transmits one loop of a waveform.
+type LoopPoint struct {
+	Channel byte
+	Number  uint16 // waveform number
+	Loop    uint16 // loop number, or LoopDeleteAll
+	Type    byte   // LoopForward, LoopPingPong or LoopNone
+	Start   uint
+	End     uint
+}
+
+// LoopPointRequest is sent by a device that wants to receive a loop of a waveform.
+type LoopPointRequest struct {
+	Channel byte
+	Number  uint16 // waveform number
+	Loop    uint16 // loop number, or LoopDeleteAll to request all loops
+}
+
+// LoopDeleteAll is the loop number which addresses all loops of a waveform. A
+// LoopPoint with this number deletes all loops.
+const LoopDeleteAll = 0x3FFF
+
+const (
+	extensionID          = 0x05
+	loopPointID          = 0x01
+	loopPointRequestID   = 0x02
+	loopPointSize        = 17
+	loopPointRequestSize = 10
+
+	extendedDumpHeaderID   = 0x05
+	extendedDumpHeaderSize = 34
+)
+
+func (msg *LoopPoint) Encode(b []byte) []byte {
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, extensionID, loopPointID)
+	b = append14bit(b, msg.Number)
+	b = append14bit(b, msg.Loop)
+	b = append(b, msg.Type&0x7F)
+	b = append20bit(b, msg.Start)
+	b = append20bit(b, msg.End)
+	return append(b, SysExEnd)
+}
+
+func (msg *LoopPointRequest) Encode(b []byte) []byte {
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, extensionID, loopPointRequestID)
+	b = append14bit(b, msg.Number)
+	b = append14bit(b, msg.Loop)
+	return append(b, SysExEnd)
+}
+
+func decodeExtension(msg []byte) (Message, error) {
+	if len(msg) < 6 {
+		return nil, ErrTooShort
+	}
+	switch msg[4] {
+	case loopPointID:
+		return decodeLoopPoint(msg)
+	case loopPointRequestID:
+		return decodeLoopPointRequest(msg)
+	case extendedDumpHeaderID:
+		return decodeExtendedDumpHeader(msg)
+	default:
+		return nil, fmt.Errorf("%w: extension message id %x", ErrUnsupportedMessage, msg[4])
+	}
+}
+
+func decodeLoopPoint(msg []byte) (Message, error) {
+	if len(msg) != loopPointSize {
+		return nil, fmt.Errorf("%w %d for LoopPoint", ErrBadSize, len(msg))
+	}
+	dec := &LoopPoint{
+		Channel: msg[2],
+		Number:  dec14bit(msg[5], msg[6]),
+		Loop:    dec14bit(msg[7], msg[8]),
+		Type:    msg[9],
+		Start:   dec20bit(msg[10], msg[11], msg[12]),
+		End:     dec20bit(msg[13], msg[14], msg[15]),
+	}
+	return dec, nil
+}
+
+func decodeLoopPointRequest(msg []byte) (Message, error) {
+	if len(msg) != loopPointRequestSize {
+		return nil, fmt.Errorf("%w %d for LoopPointRequest", ErrBadSize, len(msg))
+	}
+	dec := &LoopPointRequest{
+		Channel: msg[2],
+		Number:  dec14bit(msg[5], msg[6]),
+		Loop:    dec14bit(msg[7], msg[8]),
+	}
+	return dec, nil
+}
+
+// decodeExtendedDumpHeader decodes the extended DumpHeader, which gives the sample
+// rate in Hz as a 28-bit integer and a 28-bit fraction instead of a period, and uses
+// 35-bit lengths and loop points. It is returned as a DumpHeader with SampleRate
+// set. Period is computed from the integer part of the rate by SampleRateToPeriod, so
+// code that only looks at Period keeps working. Multi-channel waveforms are not
+// supported.
+func decodeExtendedDumpHeader(msg []byte) (Message, error) {
+	if len(msg) != extendedDumpHeaderSize {
+		return nil, fmt.Errorf("%w %d for extended DumpHeader", ErrBadSize, len(msg))
+	}
+	rate := float64(dec28bit(msg[8:12])) + float64(dec28bit(msg[12:16]))/(1<<28)
+	dec := &DumpHeader{
+		Channel:    msg[2],
+		Number:     dec14bit(msg[5], msg[6]),
+		BitDepth:   msg[7],
+		Length:     dec35bit(msg[16:21]),
+		LoopStart:  dec35bit(msg[21:26]),
+		LoopEnd:    dec35bit(msg[26:31]),
+		LoopType:   msg[31],
+		SampleRate: rate,
+	}
+	if rate >= 1 {
+		dec.Period = SampleRateToPeriod(int(rate))
+	}
+	if dec.BitDepth < MinBitDepth || dec.BitDepth > MaxBitDepth {
+		return nil, fmt.Errorf("%w %d in extended DumpHeader", ErrUnsupportedBitDepth, dec.BitDepth)
+	}
+	if channels := msg[32]; channels > 1 {
+		return nil, fmt.Errorf("%w: extended DumpHeader with %d channels", ErrUnsupportedMessage, channels)
+	}
+	return dec, nil
+}
+
+// dec28bit decodes a 28-bit number from four 7-bit bytes, least significant first.
+func dec28bit(b []byte) uint {
+	var n uint
+	for i := 3; i >= 0; i-- {
+		n = n<<7 | uint(b[i]&0x7F)
+	}
+	return n
+}
+
+// dec35bit decodes a 35-bit number from five 7-bit bytes, least significant first.
+func dec35bit(b []byte) uint {
+	return dec28bit(b) | uint(b[4]&0x7F)<<28
+}
@@ -0,0 +1,83 @@
+package sds
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLoopPointEncoding(t *testing.T) {
+	tests := []struct {
+		msg Message
+		enc []byte
+	}{
+		{
+			msg: &LoopPoint{Channel: 1, Number: 300, Loop: 1, Type: LoopPingPong, Start: 1000, End: 20000},
+			enc: []byte{0xF0, 0x7E, 0x01, 0x05, 0x01, 0x2C, 0x02, 0x01, 0x00, 0x01, 0x68, 0x07, 0x00, 0x20, 0x1C, 0x01, 0xF7},
+		},
+		{
+			msg: &LoopPointRequest{Channel: 2, Number: 5, Loop: LoopDeleteAll},
+			enc: []byte{0xF0, 0x7E, 0x02, 0x05, 0x02, 0x05, 0x00, 0x7F, 0x7F, 0xF7},
+		},
+	}
+	for _, test := range tests {
+		enc := test.msg.Encode(nil)
+		if !bytes.Equal(enc, test.enc) {
+			t.Errorf("wrong encoding of %#v:\n got %x\nwant %x", test.msg, enc, test.enc)
+		}
+		dec, err := Decode(enc)
+		if err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		if !reflect.DeepEqual(dec, test.msg) {
+			t.Errorf("wrong decoded message %#v", dec)
+		}
+	}
+}
+
+func TestDecodeExtendedDumpHeader(t *testing.T) {
+	enc := []byte{
+		0xF0, 0x7E, 0x03, 0x05, 0x05,
+		0x07, 0x00, // waveform 7
+		0x18,                   // 24 bits
+		0x44, 0x58, 0x02, 0x00, // 44100 Hz
+		0x00, 0x00, 0x00, 0x40, // + 0.5 Hz
+		0x00, 0x00, 0x00, 0x00, 0x01, // length 1<<28
+		0x0A, 0x00, 0x00, 0x00, 0x00, // loop start 10
+		0x7F, 0x7F, 0x7F, 0x7F, 0x00, // loop end 1<<28-1
+		0x01, // ping-pong
+		0x01, // mono
+		0xF7,
+	}
+	want := &DumpHeader{
+		Channel:    3,
+		Number:     7,
+		BitDepth:   24,
+		Period:     SampleRateToPeriod(44100),
+		Length:     1 << 28,
+		LoopStart:  10,
+		LoopEnd:    1<<28 - 1,
+		LoopType:   LoopPingPong,
+		SampleRate: 44100.5,
+	}
+	dec, err := Decode(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dec, want) {
+		t.Fatalf("wrong decoded header %+v", dec)
+	}
+	if r := want.Rate(); r != 44100.5 {
+		t.Errorf("Rate() = %v, want explicit rate", r)
+	}
+	if r := (&DumpHeader{Period: 20000}).Rate(); r != 50000 {
+		t.Errorf("Rate() = %v without explicit rate, want 50000", r)
+	}
+
+	// Interleaved multi-channel data can't be received.
+	enc[32] = 2
+	if _, err := Decode(enc); !errors.Is(err, ErrUnsupportedMessage) {
+		t.Errorf("wrong error %v for stereo header", err)
+	}
+}
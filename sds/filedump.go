@@ -0,0 +1,151 @@
+package sds
+
+import "fmt"
+
+// This file implements the header and data packet messages of the MIDI File Dump
+// protocol. File Dump uses the same handshake (ControlPacket) as the Sample Dump
+// Standard and is used by some samplers to transfer sample files.
+
+// FileDumpHeader is sent to the receiver to announce a file transfer.
+type FileDumpHeader struct {
+	Channel byte
+	Sender  byte   // device ID of the sender
+	Type    string // four-character file type, e.g. "MIDI" or "BIN "
+	Length  uint   // file size in bytes (max 2^28-1)
+	Name    string // file name (7-bit ASCII)
+}
+
+// FileDataPacket carries file data. It transfers 1 to 112 bytes at a time.
+type FileDataPacket struct {
+	Channel      byte
+	PacketNumber byte
+	Data         []byte // decoded file data
+	Checksum     byte
+}
+
+// MaxFileDataSize is the maximum number of file bytes in a FileDataPacket.
+const MaxFileDataSize = 112
+
+const (
+	fileDumpID         = 0x07
+	fileDumpHeaderID   = 0x01
+	fileDumpDataID     = 0x02
+	fileDumpHeaderSize = 15 // without name
+)
+
+var errFileDataSize = fmt.Errorf("%w: FileDataPacket data size exceeds 112 bytes", ErrBadSize)
+
+func (msg *FileDumpHeader) Encode(b []byte) []byte {
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, fileDumpID, fileDumpHeaderID, msg.Sender&0x7F)
+	for i := 0; i < 4; i++ {
+		c := byte(' ')
+		if i < len(msg.Type) {
+			c = msg.Type[i] & 0x7F
+		}
+		b = append(b, c)
+	}
+	b = append(b, byte(msg.Length)&0x7F, byte(msg.Length>>7)&0x7F, byte(msg.Length>>14)&0x7F, byte(msg.Length>>21)&0x7F)
+	for i := 0; i < len(msg.Name); i++ {
+		b = append(b, msg.Name[i]&0x7F)
+	}
+	return append(b, SysExEnd)
+}
+
+// Encode appends the encoded packet to b. Data beyond MaxFileDataSize bytes is
+// not encoded. The byte count field of the packet can't express zero bytes, so
+// Data must not be empty. Encode appends nothing for a packet without data.
+func (msg *FileDataPacket) Encode(b []byte) []byte {
+	data := msg.Data
+	if len(data) == 0 {
+		return b
+	}
+	if len(data) > MaxFileDataSize {
+		data = data[:MaxFileDataSize]
+	}
+	count := len(data) + (len(data)+6)/7
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, fileDumpID, fileDumpDataID, msg.PacketNumber&0x7F)
+	b = append(b, byte(count-1)&0x7F)
+	for len(data) > 0 {
+		group := data
+		if len(group) > 7 {
+			group = group[:7]
+		}
+		var msbs byte
+		for i, c := range group {
+			msbs |= (c >> 7) << (6 - i)
+		}
+		b = append(b, msbs)
+		for _, c := range group {
+			b = append(b, c&0x7F)
+		}
+		data = data[len(group):]
+	}
+	b = append(b, msg.Checksum&0x7F)
+	return append(b, SysExEnd)
+}
+
+// ComputeChecksum returns the computed checksum of the packet.
+func (msg *FileDataPacket) ComputeChecksum() byte {
+	return SDSChecksum(msg.Encode(nil))
+}
+
+func decodeFileDump(msg []byte) (Message, error) {
+	if len(msg) < 6 {
+		return nil, ErrTooShort
+	}
+	switch msg[4] {
+	case fileDumpHeaderID:
+		return decodeFileDumpHeader(msg)
+	case fileDumpDataID:
+		return decodeFileDataPacket(msg)
+	default:
+		return nil, fmt.Errorf("%w: File Dump message id %x", ErrUnsupportedMessage, msg[4])
+	}
+}
+
+func decodeFileDumpHeader(msg []byte) (Message, error) {
+	if len(msg) < fileDumpHeaderSize {
+		return nil, fmt.Errorf("%w %d for FileDumpHeader", ErrBadSize, len(msg))
+	}
+	dec := &FileDumpHeader{
+		Channel: msg[2],
+		Sender:  msg[5],
+		Type:    string(msg[6:10]),
+		Length:  uint(msg[10]&0x7F) | uint(msg[11]&0x7F)<<7 | uint(msg[12]&0x7F)<<14 | uint(msg[13]&0x7F)<<21,
+		Name:    string(msg[14 : len(msg)-1]),
+	}
+	return dec, nil
+}
+
+func decodeFileDataPacket(msg []byte) (Message, error) {
+	if len(msg) < 9 {
+		return nil, fmt.Errorf("%w %d for FileDataPacket", ErrBadSize, len(msg))
+	}
+	count := int(msg[6]) + 1
+	if len(msg) != count+9 {
+		return nil, fmt.Errorf("%w %d for FileDataPacket with byte count %d", ErrBadSize, len(msg), count)
+	}
+	dec := &FileDataPacket{
+		Channel:      msg[2],
+		PacketNumber: msg[5] & 0x7F,
+		Checksum:     msg[len(msg)-2],
+	}
+	enc := msg[7 : 7+count]
+	for len(enc) > 0 {
+		if len(enc) == 1 {
+			return nil, fmt.Errorf("%w: truncated data group in FileDataPacket", ErrBadSize)
+		}
+		msbs, group := enc[0], enc[1:]
+		if len(group) > 7 {
+			group = group[:7]
+		}
+		for i, c := range group {
+			dec.Data = append(dec.Data, c&0x7F|(msbs<<(1+i))&0x80)
+		}
+		enc = enc[1+len(group):]
+	}
+	if len(dec.Data) > MaxFileDataSize {
+		return nil, errFileDataSize
+	}
+	return dec, nil
+}
@@ -0,0 +1,68 @@
+package sds
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFileDumpEncoding(t *testing.T) {
+	payload := make([]byte, 200)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	msgs := []Message{
+		&FileDumpHeader{Channel: 1, Sender: 2, Type: "BIN ", Length: uint(len(payload)), Name: "test.bin"},
+	}
+	for i := 0; i*MaxFileDataSize < len(payload); i++ {
+		end := (i + 1) * MaxFileDataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		p := &FileDataPacket{Channel: 1, PacketNumber: byte(i), Data: payload[i*MaxFileDataSize : end]}
+		p.Checksum = p.ComputeChecksum()
+		msgs = append(msgs, p)
+	}
+
+	var received []byte
+	for _, msg := range msgs {
+		enc := msg.Encode(nil)
+		dec, err := Decode(enc)
+		if err != nil {
+			t.Fatalf("decode error: %v\nmsg: %x", err, enc)
+		}
+		if !reflect.DeepEqual(dec, msg) {
+			t.Fatalf("wrong decoded message: %#v", dec)
+		}
+		if p, ok := dec.(*FileDataPacket); ok {
+			if cs := p.ComputeChecksum(); cs != p.Checksum {
+				t.Fatalf("checksum mismatch %x != %x", cs, p.Checksum)
+			}
+			received = append(received, p.Data...)
+		}
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("wrong payload %x", received)
+	}
+}
+
+func TestFileDataPacketSizes(t *testing.T) {
+	for _, size := range []int{1, 6, 7, 8, MaxFileDataSize} {
+		p := &FileDataPacket{Channel: 1, Data: bytes.Repeat([]byte{0xAA}, size)}
+		p.Checksum = p.ComputeChecksum()
+		dec, err := Decode(p.Encode(nil))
+		if err != nil {
+			t.Fatalf("%d bytes: decode error: %v", size, err)
+		}
+		if !reflect.DeepEqual(dec, p) {
+			t.Fatalf("%d bytes: wrong decoded message %#v", size, dec)
+		}
+	}
+
+	// Empty packets can't be encoded.
+	empty := &FileDataPacket{Channel: 1}
+	if enc := empty.Encode([]byte{1}); !bytes.Equal(enc, []byte{1}) {
+		t.Fatalf("empty packet encoded as %x", enc)
+	}
+}
@@ -0,0 +1,137 @@
+package sds
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateFixtures = flag.Bool("update", false, "regenerate the gen_* files in testdata")
+
+// generatedFixtures are the test files created by TestGenerateFixtures. To cover
+// another bit depth or sample rate, add an entry here and run
+//
+//	go test -run TestGenerateFixtures -update
+//
+// TestSamples checks all of them. The WAV file of each fixture uses the smallest WAV
+// bit depth that holds the samples.
+var generatedFixtures = []fixture{
+	{name: "gen_12bit_32k", bits: 12, rate: 32000, length: 500},
+	{name: "gen_20bit_48k", bits: 20, rate: 48000, length: 500},
+	{name: "gen_28bit_96k", bits: 28, rate: 96000, length: 500},
+}
+
+type fixture struct {
+	name   string
+	bits   int
+	rate   int
+	length int
+}
+
+// fixtureWaveform returns the sample data of a generated fixture. It only uses
+// integer arithmetic, so the output is the same on all platforms. The waveform is a
+// sawtooth with added noise, and contains the minimum and maximum sample values.
+func fixtureWaveform(bits, length int) []int {
+	var (
+		min, max = FullScale(bits)
+		samples  = make([]int, length)
+		rng      = uint32(bits)*2654435761 + 1
+	)
+	for i := range samples {
+		rng ^= rng << 13
+		rng ^= rng >> 17
+		rng ^= rng << 5
+		saw := min + (max-min)/100*(i%100)
+		noise := int(rng>>16) - 1<<15
+		if bits > 17 {
+			noise <<= bits - 17
+		} else {
+			noise >>= 17 - bits
+		}
+		s := saw/2 + noise
+		if s < min {
+			s = min
+		} else if s > max {
+			s = max
+		}
+		samples[i] = s
+	}
+	if length >= 2 {
+		samples[0], samples[1] = min, max
+	}
+	return samples
+}
+
+func fixtureWAVBitDepth(bits int) int {
+	for _, d := range []int{8, 16, 24} {
+		if bits <= d {
+			return d
+		}
+	}
+	return 32
+}
+
+// generateFixture returns the content of the .sds and .wav files of f.
+func generateFixture(dir string, f fixture) (sdsData, wavData []byte, err error) {
+	samples := fixtureWaveform(f.bits, f.length)
+	sdsData = encodeSDS(samples, f.rate, f.bits)
+
+	h := &DumpHeader{BitDepth: byte(f.bits), Period: SampleRateToPeriod(f.rate), Length: uint(f.length), LoopType: LoopNone}
+	file := filepath.Join(dir, f.name+".wav")
+	fd, err := os.Create(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = WriteSDSToWAV(fd, h, samples, fixtureWAVBitDepth(f.bits), nil)
+	fd.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	wavData, err = os.ReadFile(file)
+	return sdsData, wavData, err
+}
+
+// TestGenerateFixtures checks that the generated fixtures in testdata are up to date.
+// With -update, it writes them instead.
+func TestGenerateFixtures(t *testing.T) {
+	for _, f := range generatedFixtures {
+		sdsData, wavData, err := generateFixture(t.TempDir(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ext, data := range map[string][]byte{".sds": sdsData, ".wav": wavData} {
+			file := filepath.Join("testdata", f.name+ext)
+			if *updateFixtures {
+				if err := os.WriteFile(file, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			existing, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("%v (run go test -run TestGenerateFixtures -update)", err)
+			}
+			if !bytes.Equal(existing, data) {
+				t.Errorf("%s is out of date (run go test -run TestGenerateFixtures -update)", file)
+			}
+		}
+	}
+}
+
+func TestFixtureWaveform(t *testing.T) {
+	for _, bits := range []int{8, 12, 16, 20, 24, 28} {
+		min, max := FullScale(bits)
+		samples := fixtureWaveform(bits, 300)
+		for i, s := range samples {
+			if s < min || s > max {
+				t.Fatalf("%d bits: sample %d out of range: %d", bits, i, s)
+			}
+		}
+		if fmt.Sprint(samples) != fmt.Sprint(fixtureWaveform(bits, 300)) {
+			t.Fatalf("%d bits: output not deterministic", bits)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package sds
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SetSamplesFloat copies sample data into the packet. The samples are expected to be in
+// the range [-1,1]. They are scaled to the given bit depth and clamped. It returns the
+// remaining samples.
+func (msg *DataPacket) SetSamplesFloat(samples []float64, bitDepth int) []float64 {
+	return msg.setSamplesFloat(samples, bitDepth, nil)
+}
+
+// SetSamplesFloatDither is like SetSamplesFloat, but applies triangular dither
+// from rng before quantizing the samples.
+func (msg *DataPacket) SetSamplesFloatDither(samples []float64, bitDepth int, rng *rand.Rand) []float64 {
+	return msg.setSamplesFloat(samples, bitDepth, rng)
+}
+
+func (msg *DataPacket) setSamplesFloat(samples []float64, bitDepth int, rng *rand.Rand) []float64 {
+	if bitDepth < 8 || bitDepth > 28 {
+		panic("unsupported bit depth")
+	}
+	var (
+		buf       [len(msg.Data) / 2]int
+		n         = msg.SampleCount(bitDepth)
+		low, high = FullScale(bitDepth)
+		scale     = float64(ZeroPoint(bitDepth))
+		max       = float64(high)
+		min       = float64(low)
+	)
+	if n > len(samples) {
+		n = len(samples)
+	}
+	for i, f := range samples[:n] {
+		v := f * scale
+		if rng != nil {
+			v += rng.Float64() - rng.Float64()
+		}
+		v = math.Round(v)
+		switch {
+		case v > max:
+			v = max
+		case v < min:
+			v = min
+		}
+		buf[i] = int(v)
+	}
+	msg.SetSamples(buf[:n], bitDepth)
+	return samples[n:]
+}
+
+// GetSamplesFloat decodes the sample data in packet and appends it to out. The samples
+// are normalized to the range [-1,1).
+func (msg *DataPacket) GetSamplesFloat(out []float64, bitDepth int) []float64 {
+	var buf [len(msg.Data) / 2]int
+	samples := msg.GetSamples(buf[:0], bitDepth)
+	scale := float64(ZeroPoint(bitDepth))
+	for _, s := range samples {
+		out = append(out, float64(s)/scale)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package sds
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSetSamplesFloat(t *testing.T) {
+	var msg DataPacket
+	input := []float64{0, 0.5, -0.5, 1, -1, 2, -2}
+	rem := msg.SetSamplesFloat(input, 16)
+	if len(rem) != 0 {
+		t.Fatalf("%d samples remaining", len(rem))
+	}
+	got := msg.GetSamples(nil, 16)[:len(input)]
+	want := []int{0, 16384, -16384, 32767, -32768, 32767, -32768}
+	if !samplesEqual(got, want) {
+		t.Fatalf("wrong samples %d, want %d", got, want)
+	}
+
+	// Check remainder.
+	long := make([]float64, 50)
+	if rem := msg.SetSamplesFloat(long, 16); len(rem) != 10 {
+		t.Fatalf("%d samples remaining, want 10", len(rem))
+	}
+}
+
+func TestSetSamplesFloatDither(t *testing.T) {
+	var msg DataPacket
+	rng := rand.New(rand.NewSource(1))
+	input := make([]float64, 40)
+	for i := range input {
+		input[i] = 0.25
+	}
+	msg.SetSamplesFloatDither(input, 16, rng)
+	for i, s := range msg.GetSamples(nil, 16) {
+		if s < 8191 || s > 8193 {
+			t.Fatalf("sample %d out of dither range: %d", i, s)
+		}
+	}
+}
+
+func TestGetSamplesFloat(t *testing.T) {
+	for _, bits := range []int{8, 12, 16, 20, 24, 28} {
+		var msg DataPacket
+		rng := rand.New(rand.NewSource(int64(bits)))
+		n := msg.SampleCount(bits)
+		input := make([]int, n)
+		for i := range input {
+			input[i] = rng.Intn(1<<bits) - 1<<(bits-1)
+		}
+		msg.SetSamples(input, bits)
+
+		floats := msg.GetSamplesFloat(nil, bits)
+		if len(floats) != n {
+			t.Fatalf("%d bits: got %d samples, want %d", bits, len(floats), n)
+		}
+		for i, f := range floats {
+			if f < -1 || f >= 1 {
+				t.Fatalf("%d bits: sample %d out of range: %v", bits, i, f)
+			}
+		}
+		// Converting back must yield the original integers.
+		var msg2 DataPacket
+		msg2.SetSamplesFloat(floats, bits)
+		if msg2.Data != msg.Data {
+			t.Fatalf("%d bits: float round trip mismatch", bits)
+		}
+	}
+}
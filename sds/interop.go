@@ -0,0 +1,277 @@
+package sds
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+// HeaderFromIntBuffer creates a DumpHeader describing the waveform in buf. The
+// buffer must contain mono audio.
+func HeaderFromIntBuffer(buf *audio.IntBuffer, channel byte, number uint16) *DumpHeader {
+	return &DumpHeader{
+		Channel:  channel,
+		Number:   number,
+		BitDepth: byte(buf.SourceBitDepth),
+		Period:   SampleRateToPeriod(buf.Format.SampleRate),
+		Length:   uint(len(buf.Data)),
+	}
+}
+
+// WAV loop types, as defined for the smpl chunk.
+const (
+	wavLoopForward     = 0
+	wavLoopAlternating = 1
+	wavLoopBackward    = 2
+)
+
+// LoopTypeFromWAV maps a WAV smpl chunk loop type to an SDS loop type. SDS has no
+// backward loops, so such loops are played forward over the same region instead.
+// Reserved and manufacturer-specific types map to LoopNone.
+func LoopTypeFromWAV(t uint32) byte {
+	switch t {
+	case wavLoopForward, wavLoopBackward:
+		return LoopForward
+	case wavLoopAlternating:
+		return LoopPingPong
+	default:
+		return LoopNone
+	}
+}
+
+// SetLoopFromWAV sets the loop of h from a loop of a WAV smpl chunk. Both formats
+// specify the loop end as the last sample played, so the points are taken as-is.
+func SetLoopFromWAV(h *DumpHeader, loop *wav.SampleLoop) {
+	h.LoopStart = uint(loop.Start)
+	h.LoopEnd = uint(loop.End)
+	h.LoopType = LoopTypeFromWAV(loop.Type)
+}
+
+// LoopTypeToWAV maps an SDS loop type to a WAV smpl chunk loop type. It returns
+// false for LoopNone and unknown types.
+func LoopTypeToWAV(t byte) (uint32, bool) {
+	switch t {
+	case LoopForward:
+		return wavLoopForward, true
+	case LoopPingPong:
+		return wavLoopAlternating, true
+	default:
+		return 0, false
+	}
+}
+
+// SamplerInfo creates the content of a WAV smpl chunk for the waveform described by
+// h. The chunk contains the loop of h and the given additional loops, ordered by
+// loop number. A loop with number zero in loops replaces the loop of h. Loops of
+// type LoopNone are omitted.
+func SamplerInfo(h *DumpHeader, loops []LoopPoint) *wav.SamplerInfo {
+	all := map[uint16]LoopPoint{
+		0: {Type: h.LoopType, Start: h.LoopStart, End: h.LoopEnd},
+	}
+	for _, lp := range loops {
+		if lp.Loop != LoopDeleteAll {
+			all[lp.Loop] = lp
+		}
+	}
+	numbers := make([]int, 0, len(all))
+	for n := range all {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+
+	info := &wav.SamplerInfo{MIDIUnityNote: 60, SamplePeriod: uint32(h.Period)}
+	for _, n := range numbers {
+		lp := all[uint16(n)]
+		t, ok := LoopTypeToWAV(lp.Type)
+		if !ok {
+			continue
+		}
+		info.Loops = append(info.Loops, &wav.SampleLoop{Type: t, Start: uint32(lp.Start), End: uint32(lp.End)})
+	}
+	info.NumSampleLoops = uint32(len(info.Loops))
+	return info
+}
+
+// WAVMetadata contains additional information for WriteSDSToWAV.
+type WAVMetadata struct {
+	Name  string      // stored as the title in the LIST/INFO chunk
+	Loops []LoopPoint // additional loops, e.g. received via LoopPoint messages
+}
+
+// WriteSDSToWAV writes a waveform to w as a mono WAV file with samples of the given
+// bit depth. The loops of the waveform are stored in a smpl chunk, keeping the loop
+// type: forward loops become WAV forward loops and ping-pong loops become alternating
+// loops. The sample rate is taken from h.Rate, i.e. an explicit rate from an
+// extended header is preferred over the period. meta may be nil.
+func WriteSDSToWAV(w io.WriteSeeker, h *DumpHeader, samples []int, bitDepth int, meta *WAVMetadata) error {
+	data := append([]int(nil), samples...)
+	ConvertBitDepth(data, int(h.BitDepth), bitDepth)
+	ToWAVSamples(data, bitDepth)
+	rate := int(math.Round(h.Rate()))
+	buf := &audio.IntBuffer{
+		Data:           data,
+		Format:         &audio.Format{NumChannels: 1, SampleRate: rate},
+		SourceBitDepth: bitDepth,
+	}
+	enc := wav.NewEncoder(w, rate, bitDepth, 1, 1)
+	var info *wav.SamplerInfo
+	if meta != nil {
+		if meta.Name != "" {
+			enc.Metadata = &wav.Metadata{Title: meta.Name}
+		}
+		info = SamplerInfo(h, meta.Loops)
+	} else {
+		info = SamplerInfo(h, nil)
+	}
+	if err := enc.Write(buf); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if len(info.Loops) == 0 {
+		return nil
+	}
+	return appendSamplerChunk(w, info)
+}
+
+// appendSamplerChunk writes a smpl chunk at the end of a WAV file. The go-audio/wav
+// encoder can't write smpl chunks.
+func appendSamplerChunk(w io.WriteSeeker, info *wav.SamplerInfo) error {
+	var body []byte
+	body = append(body, info.Manufacturer[:]...)
+	body = append(body, info.Product[:]...)
+	for _, v := range []uint32{info.SamplePeriod, info.MIDIUnityNote, info.MIDIPitchFraction, info.SMPTEFormat, info.SMPTEOffset, uint32(len(info.Loops)), 0} {
+		body = appendUint32LE(body, v)
+	}
+	for i, loop := range info.Loops {
+		for _, v := range []uint32{uint32(i), loop.Type, loop.Start, loop.End, loop.Fraction, loop.PlayCount} {
+			body = appendUint32LE(body, v)
+		}
+	}
+	return appendChunk(w, "smpl", body)
+}
+
+// appendChunk writes a chunk at the end of the RIFF file in w and updates the RIFF
+// chunk size.
+func appendChunk(w io.WriteSeeker, id string, body []byte) error {
+	size, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var chunk []byte
+	if size%2 == 1 {
+		chunk = append(chunk, 0) // chunks must start at even offsets
+	}
+	chunk = append(chunk, id...)
+	chunk = appendUint32LE(chunk, uint32(len(body)))
+	chunk = append(chunk, body...)
+	if _, err := w.Write(chunk); err != nil {
+		return err
+	}
+	// Update the RIFF chunk size.
+	if _, err := w.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	var riffSize [4]byte
+	binary.LittleEndian.PutUint32(riffSize[:], uint32(size)+uint32(len(chunk))-8)
+	_, err = w.Write(riffSize[:])
+	return err
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// WAVDataSize returns the size of the sample data in the WAV file in r, as given in
+// the header of its data chunk. The go-audio/wav decoder rounds the size up to an
+// even number of bytes and returns the padding byte of an odd-sized data chunk as an
+// extra sample. This affects 8-bit mono files with an odd number of samples. r is
+// read from the start.
+func WAVDataSize(r io.ReadSeeker) (int, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	size := -1
+	err := walkChunks(r, func(id string, n uint32, _ io.Reader) error {
+		if id == "data" {
+			size = int(n)
+			return errFoundChunk
+		}
+		return nil
+	})
+	if err != nil && err != errFoundChunk {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, errors.New("WAV file has no data chunk")
+	}
+	return size, nil
+}
+
+var errFoundChunk = errors.New("found chunk")
+
+// WAV files store 8-bit samples as unsigned numbers centered at 128, while samples of
+// all other bit depths are signed. SDS sample data is always signed. The following
+// functions convert between the two conventions.
+
+// FromWAVSamples converts samples read from a WAV file of the given bit depth to
+// signed values. The conversion is done in place.
+func FromWAVSamples(samples []int, bitDepth int) {
+	if bitDepth == 8 {
+		for i := range samples {
+			samples[i] -= 128
+		}
+	}
+}
+
+// ToWAVSamples converts signed samples to the WAV representation of the given bit
+// depth. The conversion is done in place.
+func ToWAVSamples(samples []int, bitDepth int) {
+	if bitDepth == 8 {
+		for i := range samples {
+			samples[i] += 128
+		}
+	}
+}
+
+// ConvertBitDepth scales signed samples from one bit depth to another. When reducing
+// the depth, the low bits are discarded. The conversion is done in place.
+func ConvertBitDepth(samples []int, from, to int) {
+	switch {
+	case to > from:
+		for i := range samples {
+			samples[i] <<= to - from
+		}
+	case to < from:
+		for i := range samples {
+			samples[i] >>= from - to
+		}
+	}
+}
+
+// WAVFormatFloat is the WAV format tag of IEEE floating point sample data.
+const WAVFormatFloat = 3
+
+// FromWAVFloat converts samples read from a 32-bit float WAV file to signed integers
+// of the given bit depth. The go-audio/wav decoder doesn't interpret float data, it
+// returns the bits of each sample as an integer. FromWAVFloat expects this
+// representation. Samples outside of [-1,1) are clamped. The conversion is done in
+// place.
+func FromWAVFloat(samples []int, bitDepth int) {
+	var (
+		low, high = FullScale(bitDepth)
+		scale     = float64(ZeroPoint(bitDepth))
+		max       = float64(high)
+		min       = float64(low)
+	)
+	for i, s := range samples {
+		v := math.Round(float64(math.Float32frombits(uint32(s))) * scale)
+		samples[i] = int(math.Max(min, math.Min(max, v)))
+	}
+}
@@ -0,0 +1,214 @@
+package sds
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-audio/wav"
+)
+
+func TestWAVSampleConversion(t *testing.T) {
+	tests := []struct {
+		bits     int
+		wav, sds []int
+	}{
+		{8, []int{0, 128, 255}, []int{-128, 0, 127}},
+		{16, []int{-32768, 0, 32767}, []int{-32768, 0, 32767}},
+		{24, []int{-8388608, 0, 8388607}, []int{-8388608, 0, 8388607}},
+	}
+	for _, test := range tests {
+		s := append([]int(nil), test.wav...)
+		FromWAVSamples(s, test.bits)
+		if !samplesEqual(s, test.sds) {
+			t.Errorf("%d bits: FromWAVSamples -> %d, want %d", test.bits, s, test.sds)
+		}
+		ToWAVSamples(s, test.bits)
+		if !samplesEqual(s, test.wav) {
+			t.Errorf("%d bits: ToWAVSamples -> %d, want %d", test.bits, s, test.wav)
+		}
+	}
+}
+
+func TestConvertBitDepth(t *testing.T) {
+	s := []int{-2048, -1, 0, 1, 2047}
+	ConvertBitDepth(s, 12, 16)
+	if want := []int{-32768, -16, 0, 16, 32752}; !samplesEqual(s, want) {
+		t.Fatalf("12 -> 16 bits: got %d, want %d", s, want)
+	}
+	ConvertBitDepth(s, 16, 12)
+	if want := []int{-2048, -1, 0, 1, 2047}; !samplesEqual(s, want) {
+		t.Fatalf("16 -> 12 bits: got %d, want %d", s, want)
+	}
+}
+
+func TestLoopTypeFromWAV(t *testing.T) {
+	tests := []struct {
+		wav uint32
+		sds byte
+	}{
+		{0, LoopForward},
+		{1, LoopPingPong},
+		{2, LoopForward},
+		{3, LoopNone},
+		{31, LoopNone},
+		{32, LoopNone},
+		{0xFFFFFFFF, LoopNone},
+	}
+	for _, test := range tests {
+		if lt := LoopTypeFromWAV(test.wav); lt != test.sds {
+			t.Errorf("WAV loop type %d: got %#x, want %#x", test.wav, lt, test.sds)
+		}
+	}
+}
+
+func TestSetLoopFromWAV(t *testing.T) {
+	h := new(DumpHeader)
+	SetLoopFromWAV(h, &wav.SampleLoop{Type: 1, Start: 100, End: 599})
+	if h.LoopStart != 100 || h.LoopEnd != 599 || h.LoopType != LoopPingPong {
+		t.Fatalf("wrong loop: start %d, end %d, type %#x", h.LoopStart, h.LoopEnd, h.LoopType)
+	}
+}
+
+func TestFromWAVFloat(t *testing.T) {
+	want, err := loadWAV("testdata/akwf1_16bit_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open("testdata/akwf1_float32_44k.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	dec := wav.NewDecoder(fd)
+	buf, err := dec.FullPCMBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.WavAudioFormat != WAVFormatFloat {
+		t.Fatalf("wrong format tag %d", dec.WavAudioFormat)
+	}
+	FromWAVFloat(buf.Data, 16)
+	if !samplesEqual(buf.Data, want.samples) {
+		t.Fatalf("samples not equal")
+	}
+
+	// Check clamping.
+	s := []int{int(math.Float32bits(1)), int(math.Float32bits(-1.5))}
+	FromWAVFloat(s, 8)
+	if want := []int{127, -128}; !samplesEqual(s, want) {
+		t.Fatalf("got %d, want %d", s, want)
+	}
+}
+
+func TestWriteSDSToWAVLoopTypes(t *testing.T) {
+	tests := []struct {
+		sdsType byte
+		wavType uint32
+	}{
+		{LoopForward, wavLoopForward},
+		{LoopPingPong, wavLoopAlternating},
+	}
+	for _, test := range tests {
+		h := &DumpHeader{BitDepth: 16, Period: SampleRateToPeriod(44100), Length: 100, LoopType: test.sdsType, LoopStart: 10, LoopEnd: 89}
+		loops := writeAndReadLoops(t, h)
+		if len(loops) != 1 {
+			t.Fatalf("type %#x: got %d loops, want 1", test.sdsType, len(loops))
+		}
+		if loops[0].Type != test.wavType {
+			t.Errorf("type %#x: WAV loop type %d, want %d", test.sdsType, loops[0].Type, test.wavType)
+		}
+		// Reading the loop back must restore the type.
+		var rh DumpHeader
+		SetLoopFromWAV(&rh, loops[0])
+		if rh.LoopType != test.sdsType || rh.LoopStart != 10 || rh.LoopEnd != 89 {
+			t.Errorf("type %#x: loop read back as %#x %d-%d", test.sdsType, rh.LoopType, rh.LoopStart, rh.LoopEnd)
+		}
+	}
+
+	// Waveforms without loop have no smpl chunk.
+	h := &DumpHeader{BitDepth: 16, Period: SampleRateToPeriod(44100), Length: 100, LoopType: LoopNone}
+	if loops := writeAndReadLoops(t, h); len(loops) != 0 {
+		t.Errorf("got %d loops for LoopNone", len(loops))
+	}
+}
+
+// writeAndReadLoops writes a WAV file with WriteSDSToWAV and returns the loops of
+// its smpl chunk.
+func writeAndReadLoops(t *testing.T, h *DumpHeader) []*wav.SampleLoop {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "out.wav")
+	fd, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := WriteSDSToWAV(fd, h, testWaveform(int(h.Length)), 16, nil); err != nil {
+		t.Fatal(err)
+	}
+	fd.Seek(0, 0)
+	dec := wav.NewDecoder(fd)
+	dec.ReadMetadata()
+	if dec.Err() != nil {
+		t.Fatal(dec.Err())
+	}
+	if dec.Metadata == nil || dec.Metadata.SamplerInfo == nil {
+		return nil
+	}
+	return dec.Metadata.SamplerInfo.Loops
+}
+
+func TestWriteSDSToWAV(t *testing.T) {
+	h := &DumpHeader{BitDepth: 16, Period: SampleRateToPeriod(44100), Length: 100, LoopType: LoopForward, LoopStart: 10, LoopEnd: 89}
+	samples := testWaveform(100)
+	meta := &WAVMetadata{
+		Name:  "saw",
+		Loops: []LoopPoint{{Loop: 1, Type: LoopPingPong, Start: 50, End: 99}},
+	}
+	file := filepath.Join(t.TempDir(), "out.wav")
+	fd, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSDSToWAV(fd, h, samples, 16, meta); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	fd, err = os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	dec := wav.NewDecoder(fd)
+	dec.ReadMetadata()
+	if dec.Err() != nil {
+		t.Fatal(dec.Err())
+	}
+	if dec.Metadata == nil || dec.Metadata.SamplerInfo == nil {
+		t.Fatal("no smpl chunk")
+	}
+	if dec.Metadata.Title != "saw" {
+		t.Errorf("wrong title %q", dec.Metadata.Title)
+	}
+	loops := dec.Metadata.SamplerInfo.Loops
+	if len(loops) != 2 {
+		t.Fatalf("got %d loops, want 2", len(loops))
+	}
+	if l := loops[0]; l.Type != wavLoopForward || l.Start != 10 || l.End != 89 {
+		t.Errorf("wrong loop 0: %+v", l)
+	}
+	if l := loops[1]; l.Type != wavLoopAlternating || l.Start != 50 || l.End != 99 {
+		t.Errorf("wrong loop 1: %+v", l)
+	}
+
+	fd.Seek(0, 0)
+	buf, err := wav.NewDecoder(fd).FullPCMBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samplesEqual(buf.Data, samples) {
+		t.Errorf("wrong samples %d", buf.Data)
+	}
+}
@@ -0,0 +1,49 @@
+package sds
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CrossfadeLoop smooths the transition from the end of a loop back to its start. The
+// last n samples of the loop are crossfaded with the n samples preceding the loop
+// start, so that the loop end flows into the loop start like the original waveform
+// does. start and end are the first and last sample of the loop. n is reduced if the
+// loop is shorter than n or there are fewer than n samples before the loop. It
+// returns the number of crossfaded samples. The samples are modified in place.
+//
+// A loop starting at the first sample has no samples before it to crossfade with,
+// CrossfadeLoop returns an error for it.
+func CrossfadeLoop(samples []int, start, end, n int) (int, error) {
+	if start < 0 || end >= len(samples) || start > end {
+		return 0, fmt.Errorf("loop %d-%d is outside of waveform", start, end)
+	}
+	if start == 0 {
+		return 0, errors.New("loop starts at the first sample, there are no samples before it to crossfade with")
+	}
+	if l := end - start + 1; n > l {
+		n = l
+	}
+	if n > start {
+		n = start
+	}
+	fadeStart := end - n + 1
+	for i := 0; i < n; i++ {
+		g := float64(i+1) / float64(n+1)
+		a := float64(samples[fadeStart+i])
+		b := float64(samples[start-n+i])
+		samples[fadeStart+i] = int(a + (b-a)*g)
+	}
+	return n, nil
+}
+
+// ReverseWaveform reverses the order of samples in place. It returns the loop
+// points of the reversed waveform for a loop from start to end, i.e. the loop
+// covers the same samples after reversal.
+func ReverseWaveform(samples []int, start, end int) (int, int) {
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+	last := len(samples) - 1
+	return last - end, last - start
+}
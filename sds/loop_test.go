@@ -0,0 +1,62 @@
+package sds
+
+import "testing"
+
+func TestCrossfadeLoop(t *testing.T) {
+	// The loop is 4..7, the samples before the loop are 100.
+	samples := []int{100, 100, 100, 100, 0, 0, 0, 0, 50}
+	n, err := CrossfadeLoop(samples, 4, 7, 3)
+	if err != nil || n != 3 {
+		t.Fatalf("crossfaded %d samples (err %v), want 3", n, err)
+	}
+	want := []int{100, 100, 100, 100, 0, 25, 50, 75, 50}
+	if !samplesEqual(samples, want) {
+		t.Fatalf("got %d, want %d", samples, want)
+	}
+
+	// The fade length is limited by the samples before the loop.
+	samples = []int{100, 0, 0, 0, 0}
+	if n, _ := CrossfadeLoop(samples, 1, 4, 3); n != 1 {
+		t.Fatalf("crossfaded %d samples, want 1", n)
+	}
+	if want := []int{100, 0, 0, 0, 50}; !samplesEqual(samples, want) {
+		t.Fatalf("got %d, want %d", samples, want)
+	}
+
+	// Loops at the start of the waveform can't be crossfaded.
+	samples = []int{0, 1, 2, 3}
+	if _, err := CrossfadeLoop(samples, 0, 3, 2); err == nil {
+		t.Fatal("no error for loop at first sample")
+	}
+	if _, err := CrossfadeLoop(samples, 1, 4, 2); err == nil {
+		t.Fatal("no error for loop outside of waveform")
+	}
+	if want := []int{0, 1, 2, 3}; !samplesEqual(samples, want) {
+		t.Fatalf("samples modified: %d", samples)
+	}
+}
+
+func TestReverseWaveform(t *testing.T) {
+	samples := []int{0, 1, 2, 3, 4, 5}
+	start, end := ReverseWaveform(samples, 1, 2)
+	if want := []int{5, 4, 3, 2, 1, 0}; !samplesEqual(samples, want) {
+		t.Fatalf("got %d, want %d", samples, want)
+	}
+	if start != 3 || end != 4 {
+		t.Fatalf("got loop %d-%d, want 3-4", start, end)
+	}
+	// The loop covers the same samples.
+	if samples[start] != 2 || samples[end] != 1 {
+		t.Fatalf("loop covers %d-%d, want 2-1", samples[start], samples[end])
+	}
+
+	// Odd length and whole-waveform loop.
+	samples = []int{7, 8, 9}
+	start, end = ReverseWaveform(samples, 0, 2)
+	if want := []int{9, 8, 7}; !samplesEqual(samples, want) {
+		t.Fatalf("got %d, want %d", samples, want)
+	}
+	if start != 0 || end != 2 {
+		t.Fatalf("got loop %d-%d, want 0-2", start, end)
+	}
+}
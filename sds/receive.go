@@ -0,0 +1,148 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const receiveLoopTimeout = 500 * time.Millisecond
+
+var (
+	errNoDumpResponse = fmt.Errorf("%w: device did not respond to DumpRequest", ErrTimeout)
+	errRequestDenied  = fmt.Errorf("%w: request denied", ErrDenied)
+)
+
+// ReceiveDump receives a waveform over t. It returns the header and samples of
+// the dump.
+//
+// Headers that fail Validate, e.g. for an empty waveform, are answered with CANCEL.
+// The transfer is also cancelled when no new sample data arrives within
+// cfg.PacketTimeout. In that case, the returned error wraps ErrTimeout.
+func ReceiveDump(ctx context.Context, t Transport, cfg *TransferConfig) (*DumpHeader, []int, error) {
+	c := cfg.withDefaults()
+	cfg = &c
+	if cfg.Request {
+		cfg.logf("requesting waveform %d", cfg.Number)
+		if err := t.Send(&DumpRequest{Channel: cfg.Channel, Number: cfg.Number}); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		cfg.logf("waiting for dump")
+	}
+	header, err := waitHeader(ctx, t, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.AnyChannel {
+		cfg.logf("locked onto SDS channel %d", header.Channel)
+		cfg.Channel = header.Channel
+	}
+	cfg.logf("<< DumpHeader: %d bits, %d samples, %s", header.BitDepth, header.Length, FormatSampleRate(header.Period))
+	if err := header.Validate(); err != nil {
+		t.Send(NewCancel(cfg.Channel, 0))
+		return nil, nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	transfer := NewReceiveOp(header)
+	if err := t.Send(NewAck(cfg.Channel, 0)); err != nil {
+		return nil, nil, err
+	}
+	var (
+		progress int
+		deadline = time.Now().Add(cfg.PacketTimeout)
+	)
+	for !transfer.Done() {
+		msg, err := receiveTimeout(ctx, t, time.Until(deadline))
+		if err != nil {
+			return nil, nil, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			t.Send(NewCancel(cfg.Channel, 0))
+			received := len(transfer.Samples())
+			return nil, nil, fmt.Errorf("%w: no valid data packet within %v (got %d of %d samples)", ErrTimeout, cfg.PacketTimeout, received, header.Length)
+		case *DataPacket:
+			if msg.Channel != cfg.Channel {
+				continue
+			}
+			before := len(transfer.Samples())
+			resp := transfer.HandlePacket(msg)
+			if resp.Type == Nak {
+				cfg.logf(">> NAK (packet %d)", resp.PacketNumber)
+			}
+			if err := t.Send(resp); err != nil {
+				return nil, nil, err
+			}
+			if len(transfer.Samples()) > before {
+				deadline = time.Now().Add(cfg.PacketTimeout)
+			}
+		case *ControlPacket:
+			if msg.Channel == cfg.Channel && msg.Type == Cancel {
+				return nil, nil, fmt.Errorf("%w: cancelled by sender", ErrDenied)
+			}
+		}
+
+		p := transfer.Progress()
+		if p-progress > 5 || (p == 100 && progress != 100) {
+			progress = p
+			cfg.logf("progress: %d%%", progress)
+		}
+	}
+	return header, transfer.Samples(), nil
+}
+
+// waitHeader waits for the DumpHeader.
+func waitHeader(ctx context.Context, t Transport, cfg *TransferConfig) (*DumpHeader, error) {
+	for {
+		msg, err := receiveTimeout(ctx, t, cfg.HandshakeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			if cfg.Request {
+				return nil, errNoDumpResponse
+			}
+		case *DumpHeader:
+			if msg.Channel != cfg.Channel && !cfg.AnyChannel {
+				continue
+			}
+			if cfg.Request && msg.Number != cfg.Number {
+				continue
+			}
+			return msg, nil
+		case *ControlPacket:
+			if msg.Channel == cfg.Channel && cfg.Request && (msg.Type == Nak || msg.Type == Cancel) {
+				return nil, errRequestDenied
+			}
+		}
+	}
+}
+
+// ReceiveLoops collects the LoopPoint messages for the waveform described by h. When
+// request is set, the loops are requested from the device using LoopPointRequest.
+// Otherwise, ReceiveLoops waits for loops sent by the device after the dump.
+// Collection stops when no loop arrives within 500ms.
+func ReceiveLoops(ctx context.Context, t Transport, h *DumpHeader, request bool) ([]LoopPoint, error) {
+	if request {
+		if err := t.Send(&LoopPointRequest{Channel: h.Channel, Number: h.Number, Loop: LoopDeleteAll}); err != nil {
+			return nil, err
+		}
+	}
+	var loops []LoopPoint
+	for {
+		msg, err := receiveTimeout(ctx, t, receiveLoopTimeout)
+		if err != nil {
+			return loops, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			return loops, nil
+		case *LoopPoint:
+			if msg.Channel == h.Channel && msg.Number == h.Number {
+				loops = append(loops, *msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReceiveDump(t *testing.T) {
+	samples := testWaveform(150)
+	h := &DumpHeader{Channel: 2, Number: 5, BitDepth: 16, Period: 22675}
+	packets := NewSendOp(samples, h).AllMessages()[1:]
+
+	// The mock device answers the request with the header, and sends the next
+	// packet whenever it gets an ACK.
+	var next int
+	sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpRequest:
+			if msg.Number == h.Number {
+				r.Respond(h, 0)
+			}
+		case *ControlPacket:
+			if msg.Type == Ack && next < len(packets) {
+				r.Respond(packets[next], 0)
+				next++
+			}
+		}
+	})
+	cfg := &TransferConfig{Channel: 2, Request: true, Number: 5}
+	rh, rsamples, err := ReceiveDump(context.Background(), sender, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rh.Length != 150 || rh.Period != h.Period {
+		t.Fatalf("wrong header %+v", rh)
+	}
+	if !samplesEqual(rsamples, samples) {
+		t.Fatalf("wrong samples %v", rsamples)
+	}
+}
+
+func TestReceiveDumpAnyChannel(t *testing.T) {
+	samples := testWaveform(150)
+	h := &DumpHeader{Channel: 9, Number: 5, BitDepth: 16, Period: 22675}
+	packets := NewSendOp(samples, h).AllMessages()[1:]
+
+	// The device sends a dump on channel 9 without being asked.
+	var next int
+	var acks []byte
+	sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if msg, ok := msg.(*ControlPacket); ok && msg.Type == Ack {
+			acks = append(acks, msg.Channel)
+			if next < len(packets) {
+				r.Respond(packets[next], 0)
+				next++
+			}
+		}
+	})
+	sender.Respond(h, 0)
+	cfg := &TransferConfig{Channel: 0, AnyChannel: true}
+	rh, rsamples, err := ReceiveDump(context.Background(), sender, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rh.Channel != 9 || !samplesEqual(rsamples, samples) {
+		t.Fatalf("wrong dump: header %+v, %d samples", rh, len(rsamples))
+	}
+	for _, ch := range acks {
+		if ch != 9 {
+			t.Fatalf("ACK sent on channel %d, want 9", ch)
+		}
+	}
+}
+
+// This checks that a packet with a corrupted data byte is rejected with a NAK for
+// that packet, and accepted when it is resent.
+func TestReceiveDumpHighBit(t *testing.T) {
+	samples := testWaveform(150)
+	h := &DumpHeader{Channel: 2, Number: 5, BitDepth: 16, Period: 22675}
+	packets := NewSendOp(samples, h).AllMessages()[1:]
+	corrupt := *packets[1].(*DataPacket)
+	corrupt.Data[10] |= 0x80
+
+	var (
+		next int
+		naks []byte
+	)
+	sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpRequest:
+			r.Respond(h, 0)
+		case *ControlPacket:
+			switch {
+			case msg.Type == Nak:
+				naks = append(naks, msg.PacketNumber)
+				r.Respond(packets[next-1], 0)
+			case msg.Type == Ack && next == 1 && len(naks) == 0:
+				r.Respond(&corrupt, 0)
+				next++
+			case msg.Type == Ack && next < len(packets):
+				r.Respond(packets[next], 0)
+				next++
+			}
+		}
+	})
+	cfg := &TransferConfig{Channel: 2, Request: true, Number: 5}
+	_, rsamples, err := ReceiveDump(context.Background(), sender, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(naks, []byte{1}) {
+		t.Fatalf("receiver sent NAKs for packets %d, want [1]", naks)
+	}
+	if !samplesEqual(rsamples, samples) {
+		t.Fatalf("wrong samples %v", rsamples)
+	}
+}
+
+func TestReceiveDumpBadHeader(t *testing.T) {
+	for _, length := range []uint{0, MaxLength + 1, 1<<21 - 1} {
+		var cancelled bool
+		sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+			switch msg := msg.(type) {
+			case *DumpRequest:
+				r.Respond(&DumpHeader{Channel: 2, Number: msg.Number, BitDepth: 16, Length: length}, 0)
+			case *ControlPacket:
+				cancelled = cancelled || msg.Type == Cancel
+			}
+		})
+		cfg := &TransferConfig{Channel: 2, Request: true, Number: 5}
+		_, _, err := ReceiveDump(context.Background(), sender, cfg)
+		if err == nil {
+			t.Fatalf("length %d: no error", length)
+		}
+		if length == 0 && !errors.Is(err, ErrEmptyWaveform) {
+			t.Errorf("length 0: got error %v, want ErrEmptyWaveform", err)
+		}
+		if !cancelled {
+			t.Errorf("length %d: receiver did not send CANCEL", length)
+		}
+	}
+}
+
+func TestReceiveDumpStall(t *testing.T) {
+	h := &DumpHeader{Channel: 2, Number: 5, BitDepth: 16, Period: 22675, Length: 1000}
+	bad := NewSendOp(testWaveform(1000), h.Clone()).AllMessages()[3].(*DataPacket)
+
+	// The sender keeps sending the wrong packet.
+	sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpRequest:
+			r.Respond(h, 0)
+		case *ControlPacket:
+			if msg.Type != Cancel {
+				r.Respond(bad, time.Millisecond)
+			}
+		}
+	})
+	cfg := &TransferConfig{Channel: 2, Request: true, Number: 5, PacketTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, _, err := ReceiveDump(context.Background(), sender, cfg)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("receiver stalled for %v", d)
+	}
+}
+
+func TestReceiveLoops(t *testing.T) {
+	h := &DumpHeader{Channel: 2, Number: 5, BitDepth: 16}
+	want := []LoopPoint{
+		{Channel: 2, Number: 5, Loop: 1, Type: LoopForward, Start: 10, End: 20},
+		{Channel: 2, Number: 5, Loop: 2, Type: LoopPingPong, Start: 30, End: 40},
+	}
+	sender := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if req, ok := msg.(*LoopPointRequest); ok && req.Loop == LoopDeleteAll {
+			r.Respond(&want[0], 0)
+			r.Respond(&LoopPoint{Channel: 2, Number: 6, Loop: 1}, 0) // other waveform
+			r.Respond(&want[1], 0)
+		}
+	})
+	loops, err := ReceiveLoops(context.Background(), sender, h, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loops, want) {
+		t.Fatalf("wrong loops %+v", loops)
+	}
+}
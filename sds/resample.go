@@ -0,0 +1,23 @@
+package sds
+
+import "math"
+
+// ResampleLoop resamples one cycle of a looped waveform to n samples using linear
+// interpolation. The input is treated as periodic, i.e. the sample after the last
+// one is the first one. This keeps the loop seamless.
+func ResampleLoop(samples []int, n int) []int {
+	out := make([]int, n)
+	if len(samples) == 0 {
+		return out
+	}
+	step := float64(len(samples)) / float64(n)
+	for i := range out {
+		pos := float64(i) * step
+		j := int(pos)
+		frac := pos - float64(j)
+		a := float64(samples[j])
+		b := float64(samples[(j+1)%len(samples)])
+		out[i] = int(math.Round(a + (b-a)*frac))
+	}
+	return out
+}
@@ -0,0 +1,21 @@
+package sds
+
+import "testing"
+
+func TestResampleLoop(t *testing.T) {
+	tests := []struct {
+		in   []int
+		n    int
+		want []int
+	}{
+		{[]int{0, 100, 0, -100}, 8, []int{0, 50, 100, 50, 0, -50, -100, -50}},
+		{[]int{0, 50, 100, 50, 0, -50, -100, -50}, 4, []int{0, 100, 0, -100}},
+		{[]int{10, 20, 30}, 3, []int{10, 20, 30}},
+		{nil, 2, []int{0, 0}},
+	}
+	for _, test := range tests {
+		if out := ResampleLoop(test.in, test.n); !samplesEqual(out, test.want) {
+			t.Errorf("ResampleLoop(%d, %d) -> %d, want %d", test.in, test.n, out, test.want)
+		}
+	}
+}
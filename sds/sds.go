@@ -1,10 +1,22 @@
 // Package sds implements the MIDI Sample Dump Standard.
+//
+// # Padding
+//
+// A DataPacket always carries a fixed number of samples, which depends on the bit
+// depth (see DataPacket.SampleCount). When the waveform length isn't a multiple of
+// that number, the final packet is filled up with zero samples. Receivers must use
+// the Length field of the DumpHeader to find the end of the waveform and discard the
+// padding. SendOp always sets Length to the exact number of samples sent, and
+// ReceiveOp and SampleReader never return more than Length samples.
 package sds
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"time"
 )
 
 // DumpHeader is sent to the receiver to provide information about the waveform data that
@@ -18,10 +30,164 @@ type DumpHeader struct {
 	Period   uint // sample period in nanoseconds, i.e. 1.000.000.000/samplerate
 	Length   uint // total number of samples in waveform
 
-	// Sustain loop.
+	// Sustain loop. The loop points are sample indexes and are encoded with 20
+	// bits, like Length, so they can't exceed MaxLength.
 	LoopStart uint
 	LoopEnd   uint
 	LoopType  byte
+
+	// SampleRate is the sample rate in Hz given by an extended DumpHeader. It is
+	// zero for standard headers. Encode doesn't transmit it. See Rate.
+	SampleRate float64
+}
+
+// Duration returns the playback duration of the waveform.
+func (h *DumpHeader) Duration() time.Duration {
+	if h.Period == 0 {
+		return 0
+	}
+	return time.Duration(h.Length) * time.Duration(h.Period)
+}
+
+// Rate returns the sample rate of the waveform in Hz. The explicit SampleRate of an
+// extended header takes precedence over the rate derived from Period, because the
+// period is rounded to whole nanoseconds and can't represent most rates exactly.
+func (h *DumpHeader) Rate() float64 {
+	if h.SampleRate > 0 {
+		return h.SampleRate
+	}
+	return PeriodToSampleRate(h.Period)
+}
+
+// ExpectedPackets returns the number of DataPackets needed to transfer the waveform
+// announced by h.
+func ExpectedPackets(h *DumpHeader) int {
+	count := new(DataPacket).SampleCount(int(h.BitDepth))
+	return (int(h.Length) + count - 1) / count
+}
+
+// BroadcastChannel is the SDS channel number which some devices treat as "all
+// channels". They accept messages on it, but respond on their own channel.
+const BroadcastChannel = 0x7F
+
+// MatchChannel reports whether a response on channel got belongs to a transfer on
+// channel ch. This is the case when the channels are equal, or when ch is
+// BroadcastChannel.
+func MatchChannel(ch, got byte) bool {
+	return got == ch || ch == BroadcastChannel
+}
+
+// Range of supported sample bit depths.
+const (
+	MinBitDepth = 8
+	MaxBitDepth = 28
+)
+
+// ZeroPoint returns the unsigned value that represents silence in data packets of
+// the given bit depth. Signed samples are transmitted with this value added.
+func ZeroPoint(bitDepth int) int {
+	return 1 << (bitDepth - 1)
+}
+
+// FullScale returns the range of signed sample values at the given bit depth.
+func FullScale(bitDepth int) (min, max int) {
+	zero := ZeroPoint(bitDepth)
+	return -zero, zero - 1
+}
+
+// MaxLength is the maximum number of samples in a waveform.
+const MaxLength = 1<<20 - 1
+
+// MaxPeriod is the maximum sample period, corresponding to a sample rate of
+// approximately 954 Hz.
+const MaxPeriod = 1<<20 - 1
+
+// SampleRateToPeriod converts a sample rate in Hz to the sample period in nanoseconds.
+// It returns zero for rates below 1 Hz, which Validate rejects.
+func SampleRateToPeriod(rate int) uint {
+	if rate <= 0 {
+		return 0
+	}
+	return uint(1000000000 / rate)
+}
+
+// PeriodToSampleRate converts a sample period in nanoseconds to the sample rate in Hz.
+func PeriodToSampleRate(period uint) float64 {
+	if period == 0 {
+		return 0
+	}
+	return 1000000000 / float64(period)
+}
+
+// standardSampleRates are the sample rates recognized by FormatSampleRate.
+var standardSampleRates = []int{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000, 88200, 96000}
+
+// FormatSampleRate returns a human-readable description of the sample rate of the
+// given period. Common sample rates are shown in kHz, e.g. "44.1 kHz", even though
+// the period can't represent them exactly. Other rates are shown in Hz.
+func FormatSampleRate(period uint) string {
+	for _, rate := range standardSampleRates {
+		if SampleRateToPeriod(rate) == period {
+			return strconv.FormatFloat(float64(rate)/1000, 'f', -1, 64) + " kHz"
+		}
+	}
+	rate := math.Round(PeriodToSampleRate(period)*100) / 100
+	return strconv.FormatFloat(rate, 'f', -1, 64) + " Hz"
+}
+
+// ErrEmptyWaveform is returned by Validate and SendOp.Run for waveforms without
+// samples.
+var ErrEmptyWaveform = errors.New("waveform has no samples")
+
+// Validate checks that the header can be encoded without loss.
+func (h *DumpHeader) Validate() error {
+	if h.BitDepth < MinBitDepth || h.BitDepth > MaxBitDepth {
+		return fmt.Errorf("%w %d", ErrUnsupportedBitDepth, h.BitDepth)
+	}
+	if h.Length == 0 {
+		return ErrEmptyWaveform
+	}
+	if h.Length > MaxLength {
+		return fmt.Errorf("waveform length %d exceeds maximum of %d samples", h.Length, MaxLength)
+	}
+	if h.Period == 0 {
+		return errors.New("sample period is zero")
+	}
+	if h.Period > MaxPeriod {
+		return fmt.Errorf("sample period %dns exceeds maximum of %dns", h.Period, MaxPeriod)
+	}
+	if h.LoopStart > MaxLength || h.LoopEnd > MaxLength {
+		return fmt.Errorf("loop %d-%d can't be encoded, loop points must not exceed %d", h.LoopStart, h.LoopEnd, MaxLength)
+	}
+	return nil
+}
+
+// Clone returns a copy of the header.
+func (h *DumpHeader) Clone() *DumpHeader {
+	cpy := *h
+	return &cpy
+}
+
+// Diff compares h with another header and returns a description of each field that
+// differs, e.g. "Length 600 vs 598". It returns nil if the headers are equal.
+func (h *DumpHeader) Diff(other *DumpHeader) []string {
+	var diffs []string
+	add := func(field string, a, b uint) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s %d vs %d", field, a, b))
+		}
+	}
+	add("Channel", uint(h.Channel), uint(other.Channel))
+	add("Number", uint(h.Number), uint(other.Number))
+	add("BitDepth", uint(h.BitDepth), uint(other.BitDepth))
+	add("Period", h.Period, other.Period)
+	add("Length", h.Length, other.Length)
+	add("LoopStart", h.LoopStart, other.LoopStart)
+	add("LoopEnd", h.LoopEnd, other.LoopEnd)
+	if h.LoopType != other.LoopType {
+		diffs = append(diffs, fmt.Sprintf("LoopType %#x vs %#x", h.LoopType, other.LoopType))
+	}
+	return diffs
 }
 
 // Loop types.
@@ -46,6 +212,12 @@ type DataPacket struct {
 	Checksum     byte
 }
 
+// Clone returns a copy of the packet.
+func (msg *DataPacket) Clone() *DataPacket {
+	cpy := *msg
+	return &cpy
+}
+
 // ControlPacket is sent to control the data transfer.
 type ControlPacket struct {
 	Type         ControlPacketType
@@ -96,6 +268,26 @@ const (
 	Wait = ControlPacketType(0x7C)
 )
 
+// NewAck creates an ACK control packet.
+func NewAck(ch, pkt byte) *ControlPacket {
+	return &ControlPacket{Type: Ack, Channel: ch, PacketNumber: pkt}
+}
+
+// NewNak creates a NAK control packet.
+func NewNak(ch, pkt byte) *ControlPacket {
+	return &ControlPacket{Type: Nak, Channel: ch, PacketNumber: pkt}
+}
+
+// NewCancel creates a CANCEL control packet.
+func NewCancel(ch, pkt byte) *ControlPacket {
+	return &ControlPacket{Type: Cancel, Channel: ch, PacketNumber: pkt}
+}
+
+// NewWait creates a WAIT control packet.
+func NewWait(ch, pkt byte) *ControlPacket {
+	return &ControlPacket{Type: Wait, Channel: ch, PacketNumber: pkt}
+}
+
 // Message represents any SDS protocol message.
 type Message interface {
 	// Encode appends the encoding of the message to 'buf'.
@@ -103,7 +295,7 @@ type Message interface {
 }
 
 func (msg *DumpHeader) Encode(b []byte) []byte {
-	b = append(b, 0xF0, 0x7E, msg.Channel&0x7F, 0x01)
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, 0x01)
 	b = append14bit(b, msg.Number)
 	b = append(b, msg.BitDepth&0x7F)
 	b = append20bit(b, msg.Period)
@@ -111,25 +303,25 @@ func (msg *DumpHeader) Encode(b []byte) []byte {
 	b = append20bit(b, msg.LoopStart)
 	b = append20bit(b, msg.LoopEnd)
 	b = append(b, msg.LoopType&0x7F)
-	return append(b, 0xF7)
+	return append(b, SysExEnd)
 }
 
 func (msg *DataPacket) Encode(b []byte) []byte {
-	b = append(b, 0xF0, 0x7E, msg.Channel&0x7F, 0x02)
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, 0x02)
 	b = append(b, msg.PacketNumber&0x7F)
 	b = append(b, msg.Data[:]...)
 	b = append(b, msg.Checksum&0x7F)
-	return append(b, 0xF7)
+	return append(b, SysExEnd)
 }
 
 func (msg *DumpRequest) Encode(b []byte) []byte {
-	b = append(b, 0xF0, 0x7E, msg.Channel&0x7F, 0x03)
+	b = append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, 0x03)
 	b = append14bit(b, msg.Number)
-	return append(b, 0xF7)
+	return append(b, SysExEnd)
 }
 
 func (msg *ControlPacket) Encode(b []byte) []byte {
-	return append(b, 0xF0, 0x7E, msg.Channel&0x7F, byte(msg.Type)&0x7F, msg.PacketNumber&0x7F, 0xF7)
+	return append(b, SysExStart, UniversalNonRealtime, msg.Channel&0x7F, byte(msg.Type)&0x7F, msg.PacketNumber&0x7F, SysExEnd)
 }
 
 func append14bit(b []byte, num uint16) []byte {
@@ -147,21 +339,67 @@ const (
 	controlPacketSize = 6
 )
 
+// Errors returned by Decode and Decoder. Most decoding errors wrap one of these
+// with details about the message.
 var (
-	errNotSysex = errors.New("not a sysex message")
-	errTooShort = errors.New("message too short")
-	errChecksum = errors.New("bad checksum")
+	ErrNotSysex            = errors.New("not a sysex message")
+	ErrTooShort            = errors.New("message too short")
+	ErrBadSize             = errors.New("bad size")
+	ErrUnsupportedMessage  = errors.New("unsupported message")
+	ErrUnsupportedBitDepth = errors.New("unsupported bit depth")
+	ErrChecksum            = errors.New("bad checksum")
+	ErrHighBit             = errors.New("data byte with high bit set")
 )
 
-var prefix = []byte{0xF0, 0x7E}
+// ChecksumError is returned by Decoder for a DataPacket whose checksum doesn't match
+// its content. It wraps ErrChecksum.
+type ChecksumError struct {
+	Packet byte // packet number
+	Got    byte // checksum contained in the packet
+	Want   byte // checksum computed from the packet content
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bad checksum %#x in packet %d, want %#x", e.Got, e.Packet, e.Want)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksum
+}
+
+// SDS messages are universal non-realtime system exclusive messages. These constants
+// describe their framing.
+const (
+	SysExStart           = 0xF0 // first byte of a sysex message
+	SysExEnd             = 0xF7 // last byte of a sysex message
+	UniversalNonRealtime = 0x7E // second byte of a universal non-realtime message
+)
+
+// SysExPrefix is the beginning of every SDS message. The byte following the prefix
+// is the device channel.
+var SysExPrefix = []byte{SysExStart, UniversalNonRealtime}
+
+// DecodeUnterminated is like Decode, but also accepts a message without the final
+// F7 byte. This is meant for MIDI drivers which strip the terminator, or deliver it
+// as a separate message. No specific driver is known to do this.
+//
+// The terminator is restored before decoding. Since SDS messages are either of fixed
+// size or, for FileDataPacket, carry their size, a message that is missing more
+// than the terminator is still rejected with ErrBadSize.
+func DecodeUnterminated(sysex []byte) (Message, error) {
+	if len(sysex) > 0 && sysex[len(sysex)-1] != SysExEnd {
+		sysex = append(sysex[:len(sysex):len(sysex)], SysExEnd)
+	}
+	return Decode(sysex)
+}
 
 // Decode decodes a MIDI SDS message. The buffer must contain a complete MIDI message.
 func Decode(sysex []byte) (Message, error) {
-	if !bytes.HasPrefix(sysex, prefix) || sysex[len(sysex)-1] != 0xF7 {
-		return nil, errNotSysex
-	}
 	if len(sysex) < 4 {
-		return nil, errTooShort
+		return nil, ErrTooShort
+	}
+	if !bytes.HasPrefix(sysex, SysExPrefix) || sysex[len(sysex)-1] != SysExEnd {
+		return nil, ErrNotSysex
 	}
 	switch sysex[3] {
 	case 0x01:
@@ -170,16 +408,20 @@ func Decode(sysex []byte) (Message, error) {
 		return decodeDataPacket(sysex)
 	case 0x03:
 		return decodeDumpRequest(sysex)
+	case extensionID:
+		return decodeExtension(sysex)
+	case fileDumpID:
+		return decodeFileDump(sysex)
 	case 0x7C, 0x7D, 0x7E, 0x7F:
 		return decodeControlPacket(sysex)
 	default:
-		return nil, fmt.Errorf("invalid message id %x", sysex[3])
+		return nil, fmt.Errorf("%w: message id %x", ErrUnsupportedMessage, sysex[3])
 	}
 }
 
 func decodeDumpHeader(msg []byte) (Message, error) {
 	if len(msg) != dumpHeaderSize {
-		return nil, fmt.Errorf("bad size %d for DumpHeader", len(msg))
+		return nil, fmt.Errorf("%w %d for DumpHeader", ErrBadSize, len(msg))
 	}
 	dec := &DumpHeader{
 		Channel:   msg[2],
@@ -191,19 +433,19 @@ func decodeDumpHeader(msg []byte) (Message, error) {
 		LoopEnd:   dec20bit(msg[16], msg[17], msg[18]),
 		LoopType:  msg[19],
 	}
-	if dec.BitDepth < 8 || dec.BitDepth > 28 {
-		return nil, fmt.Errorf("unsupported bit depth %d in DumpHeader", dec.BitDepth)
+	if dec.BitDepth < MinBitDepth || dec.BitDepth > MaxBitDepth {
+		return nil, fmt.Errorf("%w %d in DumpHeader", ErrUnsupportedBitDepth, dec.BitDepth)
 	}
 	return dec, nil
 }
 
 func decodeDataPacket(msg []byte) (Message, error) {
 	if len(msg) != dataPacketSize {
-		return nil, fmt.Errorf("bad size %d for DataPacket", len(msg))
+		return nil, fmt.Errorf("%w %d for DataPacket", ErrBadSize, len(msg))
 	}
 	dec := &DataPacket{
 		Channel:      msg[2],
-		PacketNumber: msg[4],
+		PacketNumber: msg[4] & 0x7F,
 		Checksum:     msg[125],
 	}
 	copy(dec.Data[:], msg[5:125])
@@ -212,7 +454,7 @@ func decodeDataPacket(msg []byte) (Message, error) {
 
 func decodeDumpRequest(msg []byte) (Message, error) {
 	if len(msg) != dumpRequestSize {
-		return nil, fmt.Errorf("bad size %d for DumpRequest", len(msg))
+		return nil, fmt.Errorf("%w %d for DumpRequest", ErrBadSize, len(msg))
 	}
 	dec := &DumpRequest{
 		Channel: msg[2],
@@ -223,12 +465,12 @@ func decodeDumpRequest(msg []byte) (Message, error) {
 
 func decodeControlPacket(msg []byte) (Message, error) {
 	if len(msg) != controlPacketSize {
-		return nil, fmt.Errorf("bad size %d for ControlPacket", len(msg))
+		return nil, fmt.Errorf("%w %d for ControlPacket", ErrBadSize, len(msg))
 	}
 	dec := &ControlPacket{
 		Channel:      msg[2],
 		Type:         ControlPacketType(msg[3]),
-		PacketNumber: msg[4],
+		PacketNumber: msg[4] & 0x7F,
 	}
 	return dec, nil
 }
@@ -241,88 +483,210 @@ func dec20bit(l, m, h byte) uint {
 	return uint(l&0x7F) | uint(m&0x7F)<<7 | uint(h&0x3F)<<14
 }
 
+// SDSChecksum computes the checksum of a raw DataPacket or FileDataPacket. b must be
+// the complete message from F0 to F7, with the checksum in the byte before F7. The
+// checksum is the XOR of all bytes between F0 and the checksum, masked to seven bits.
+// The current value of the checksum byte doesn't affect the result.
+func SDSChecksum(b []byte) byte {
+	if len(b) < 3 {
+		return 0
+	}
+	var c byte
+	for _, v := range b[1 : len(b)-2] {
+		c ^= v
+	}
+	return c & 0x7F
+}
+
 // ComputeChecksum returns the computed checksum of the packet.
 func (msg *DataPacket) ComputeChecksum() byte {
 	var buf [dataPacketSize]byte
-	msg.Encode(buf[:0])
-	c := buf[0]
-	for i := range buf[1 : dataPacketSize-1] {
-		c ^= buf[i]
+	return SDSChecksum(msg.Encode(buf[:0]))
+}
+
+// Valid7Bit reports whether all data bytes of the packet are valid MIDI data bytes,
+// i.e. have the high bit clear. A byte with the high bit set indicates a
+// transmission error and would be masked off by GetSamples.
+func (msg *DataPacket) Valid7Bit() bool {
+	for _, b := range msg.Data {
+		if b > 0x7F {
+			return false
+		}
 	}
-	return c & 0x7F
+	return true
+}
+
+// SampleCount returns the number of samples contained in a packet at the given bit
+// depth. This is a fixed number: 60 samples for depths up to 14 bits, 40 samples up to
+// 21 bits and 30 samples for larger depths.
+func (msg *DataPacket) SampleCount(bitDepth int) int {
+	return len(msg.Data) / bytesPerSample(bitDepth)
 }
 
-// GetSamples decodes the sample data in packet and appends it to s.
+// bytesPerSample returns the number of data bytes used for a sample.
+func bytesPerSample(bitDepth int) int {
+	switch {
+	case bitDepth <= 14:
+		return 2
+	case bitDepth <= 21:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// GetSamples decodes the sample data in packet and appends it to s. It always
+// decodes SampleCount samples. Note that the final packet of a dump is padded with
+// zero samples, so callers reassembling a waveform must trim the result to the
+// Length given in the DumpHeader, or use GetSamplesN. ReceiveOp and SampleReader do
+// this automatically.
 func (msg *DataPacket) GetSamples(s []int, bitDepth int) []int {
+	return msg.GetSamplesN(s, bitDepth, msg.SampleCount(bitDepth))
+}
+
+// GetSamplesN is like GetSamples, but decodes only the first n samples of the packet.
+// If n exceeds SampleCount, all samples are decoded.
+func (msg *DataPacket) GetSamplesN(s []int, bitDepth int, n int) []int {
+	if n < 0 {
+		n = 0
+	}
 	switch {
 	case bitDepth < 8:
 		panic("bit depth < 8 is not supported")
 	case bitDepth <= 14:
-		return msg.read2(s, bitDepth)
+		return msg.read2(s, bitDepth, n)
+	case bitDepth == 16:
+		return msg.read16(s, n)
 	case bitDepth <= 21:
-		return msg.read3(s, bitDepth)
+		return msg.read3(s, bitDepth, n)
 	case bitDepth <= 28:
-		return msg.read4(s, bitDepth)
+		return msg.read4(s, bitDepth, n)
 	default:
 		panic("bit depth > 28 is not supported")
 	}
 }
 
-func (msg *DataPacket) read2(out []int, bits int) []int {
+// GetSamplesInto decodes the sample data in packet into dst. It returns the number
+// of samples written, which is the smaller of SampleCount and len(dst). This can be
+// used to reassemble a waveform into a slice of the Length given in the DumpHeader,
+// which avoids repeated allocation and is considerably faster than appending with
+// GetSamples for long waveforms (see BenchmarkReassemble).
+func (msg *DataPacket) GetSamplesInto(dst []int, bitDepth int) int {
+	return len(msg.GetSamplesN(dst[:0], bitDepth, len(dst)))
+}
+
+// GetSamplesInt16 decodes the sample data in packet and appends it to out as 16-bit
+// samples. Samples of lower bit depth are scaled up. The bit depth must not exceed 16.
+// This is faster than converting the output of GetSamples, see
+// BenchmarkGetSamplesInt16.
+func (msg *DataPacket) GetSamplesInt16(out []int16, bitDepth int) []int16 {
+	switch {
+	case bitDepth < 8:
+		panic("bit depth < 8 is not supported")
+	case bitDepth > 16:
+		panic("GetSamplesInt16 requires bit depth <= 16")
+	}
+	var (
+		zero  = uint(ZeroPoint(bitDepth))
+		scale = 16 - bitDepth
+	)
+	if bitDepth <= 14 {
+		shiftH, shiftL := bitDepth-7, 14-bitDepth
+		for i := 0; i+1 < len(msg.Data); i += 2 {
+			v := uint(msg.Data[i]&0x7F)<<shiftH | uint(msg.Data[i+1]&0x7F)>>shiftL
+			out = append(out, int16(int(v-zero)<<scale))
+		}
+		return out
+	}
+	shiftH, shiftM, shiftL := bitDepth-7, bitDepth-14, 21-bitDepth
+	for i := 0; i+2 < len(msg.Data); i += 3 {
+		v := uint(msg.Data[i]&0x7F)<<shiftH | uint(msg.Data[i+1]&0x7F)<<shiftM | uint(msg.Data[i+2]&0x7F)>>shiftL
+		out = append(out, int16(int(v-zero)<<scale))
+	}
+	return out
+}
+
+func (msg *DataPacket) read2(out []int, bits int, n int) []int {
 	var (
-		shiftH   = bits - 7
-		shiftL   = 14 - bits
-		zero     = uint(1) << (bits - 1)
-		buf      [len(msg.Data) / 2]int
-		bufIndex int
+		shiftH = bits - 7
+		shiftL = 14 - bits
+		zero   = uint(ZeroPoint(bits))
 	)
-	for i := 0; i < len(msg.Data); i += 2 {
+	if count := len(msg.Data) / 2; n > count {
+		n = count
+	}
+	out, buf := growSamples(out, n)
+	for i, j := 0, 0; j < n; i, j = i+2, j+1 {
 		v := uint(msg.Data[i]&0x7F) << shiftH
 		v |= uint(msg.Data[i+1]&0x7F) >> shiftL
-		buf[bufIndex] = int(v - zero)
-		bufIndex++
+		buf[j] = int(v - zero)
 	}
-	return append(out, buf[:]...)
+	return out
 }
 
-func (msg *DataPacket) read3(out []int, bits int) []int {
+func (msg *DataPacket) read3(out []int, bits int, n int) []int {
 	var (
-		shiftH   = bits - 7
-		shiftM   = bits - 14
-		shiftL   = 21 - bits
-		zero     = uint(1) << (bits - 1)
-		buf      [len(msg.Data) / 3]int
-		bufIndex int
+		shiftH = bits - 7
+		shiftM = bits - 14
+		shiftL = 21 - bits
+		zero   = uint(ZeroPoint(bits))
 	)
-	for i := 0; i < len(msg.Data); i += 3 {
+	if count := len(msg.Data) / 3; n > count {
+		n = count
+	}
+	out, buf := growSamples(out, n)
+	for i, j := 0, 0; j < n; i, j = i+3, j+1 {
 		v := uint(msg.Data[i]&0x7F) << shiftH
 		v |= uint(msg.Data[i+1]&0x7F) << shiftM
 		v |= uint(msg.Data[i+2]&0x7F) >> shiftL
-		buf[bufIndex] = int(v - zero)
-		bufIndex++
+		buf[j] = int(v - zero)
 	}
-	return append(out, buf[:]...)
+	return out
 }
 
-func (msg *DataPacket) read4(out []int, bits int) []int {
+// read16 is read3 specialized for 16-bit samples, which is the most common depth.
+func (msg *DataPacket) read16(out []int, n int) []int {
+	if count := len(msg.Data) / 3; n > count {
+		n = count
+	}
+	out, buf := growSamples(out, n)
+	data := msg.Data[:n*3]
+	for j := range buf {
+		d := data[j*3 : j*3+3]
+		v := uint(d[0]&0x7F)<<9 | uint(d[1]&0x7F)<<2 | uint(d[2]&0x7F)>>5
+		buf[j] = int(v) - 0x8000
+	}
+	return out
+}
+
+func (msg *DataPacket) read4(out []int, bits int, n int) []int {
 	var (
-		shiftH   = bits - 7
-		shiftM1  = bits - 14
-		shiftM2  = bits - 21
-		shiftL   = 28 - bits
-		zero     = uint(1) << (bits - 1)
-		buf      [len(msg.Data) / 4]int
-		bufIndex int
+		shiftH  = bits - 7
+		shiftM1 = bits - 14
+		shiftM2 = bits - 21
+		shiftL  = 28 - bits
+		zero    = uint(ZeroPoint(bits))
 	)
-	for i := 0; i < len(msg.Data); i += 4 {
+	if count := len(msg.Data) / 4; n > count {
+		n = count
+	}
+	out, buf := growSamples(out, n)
+	for i, j := 0, 0; j < n; i, j = i+4, j+1 {
 		v := uint(msg.Data[i]&0x7F) << shiftH
 		v |= uint(msg.Data[i+1]&0x7F) << shiftM1
 		v |= uint(msg.Data[i+2]&0x7F) << shiftM2
 		v |= uint(msg.Data[i+3]&0x7F) >> shiftL
-		buf[bufIndex] = int(v - zero)
-		bufIndex++
+		buf[j] = int(v - zero)
 	}
-	return append(out, buf[:]...)
+	return out
+}
+
+// growSamples extends s by n elements. It returns the extended slice and the
+// added elements.
+func growSamples(s []int, n int) ([]int, []int) {
+	start := len(s)
+	s = append(s, make([]int, n)...)
+	return s, s[start:]
 }
 
 // SetSamples copies sample data into the packet. It returns the remaining samples.
@@ -332,6 +696,8 @@ func (msg *DataPacket) SetSamples(samples []int, bitDepth int) []int {
 		panic("bit depth < 8 is not supported")
 	case bitDepth <= 14:
 		return msg.write2(samples, bitDepth)
+	case bitDepth == 16:
+		return msg.write16(samples)
 	case bitDepth <= 21:
 		return msg.write3(samples, bitDepth)
 	case bitDepth <= 28:
@@ -345,7 +711,7 @@ func (msg *DataPacket) write2(samples []int, bits int) []int {
 	var (
 		shiftH = bits - 7
 		shiftL = 14 - bits
-		zero   = uint(1) << (bits - 1)
+		zero   = uint(ZeroPoint(bits))
 		si, di = 0, 0
 	)
 	// Encode sample data.
@@ -366,7 +732,7 @@ func (msg *DataPacket) write3(samples []int, bits int) []int {
 		shiftH = bits - 7
 		shiftM = bits - 14
 		shiftL = 21 - bits
-		zero   = uint(1) << (bits - 1)
+		zero   = uint(ZeroPoint(bits))
 		si, di = 0, 0
 	)
 	// Encode sample data.
@@ -383,13 +749,33 @@ func (msg *DataPacket) write3(samples []int, bits int) []int {
 	return samples[si:]
 }
 
+// write16 is write3 specialized for 16-bit samples.
+func (msg *DataPacket) write16(samples []int) []int {
+	n := len(msg.Data) / 3
+	if len(samples) < n {
+		n = len(samples)
+	}
+	for i, s := range samples[:n] {
+		v := uint(s) + 0x8000
+		d := msg.Data[i*3 : i*3+3]
+		d[0] = byte(v>>9) & 0x7F
+		d[1] = byte(v>>2) & 0x7F
+		d[2] = byte(v<<5) & 0x7F
+	}
+	// Zero remainder of msg.Data.
+	for di := n * 3; di < len(msg.Data); di++ {
+		msg.Data[di] = 0
+	}
+	return samples[n:]
+}
+
 func (msg *DataPacket) write4(samples []int, bits int) []int {
 	var (
 		shiftH  = bits - 7
 		shiftM1 = bits - 14
 		shiftM2 = bits - 21
 		shiftL  = 28 - bits
-		zero    = uint(1) << (bits - 1)
+		zero    = uint(ZeroPoint(bits))
 		si, di  = 0, 0
 	)
 	// Encode sample data.
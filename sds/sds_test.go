@@ -1,8 +1,8 @@
 package sds
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
@@ -41,10 +42,14 @@ func Test20bit(t *testing.T) {
 
 func TestMessageEncoding(t *testing.T) {
 	tests := []Message{
-		&DumpHeader{1, 2, 16, 4, 5, 6, 7, 8},
+		&DumpHeader{1, 2, 16, 4, 5, 6, 7, 8, 0},
 		&DumpRequest{1, 2},
 		&DataPacket{1, 2, [120]byte{3, 4, 5, 6}, 7},
 		&ControlPacket{Ack, 1, 8},
+		NewAck(1, 8),
+		NewNak(2, 9),
+		NewCancel(3, 10),
+		NewWait(4, 11),
 	}
 
 	for _, msg := range tests {
@@ -60,17 +65,313 @@ func TestMessageEncoding(t *testing.T) {
 	}
 }
 
-func TestSamples(t *testing.T) {
+func TestDumpHeaderDuration(t *testing.T) {
+	h := &DumpHeader{Period: SampleRateToPeriod(44100), Length: 600}
+	if d := h.Duration(); d != 13605*time.Microsecond {
+		t.Fatalf("wrong duration %v", d)
+	}
+	h.Period = 0
+	if d := h.Duration(); d != 0 {
+		t.Fatalf("wrong duration %v for zero period", d)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	header := (&DumpHeader{BitDepth: 16}).Encode(nil)
+	badDepth := append([]byte(nil), header...)
+	badDepth[6] = 30
 	tests := []struct {
-		name   string
-		bits   int
-		rate   int
-		length int
+		msg []byte
+		err error
 	}{
+		{[]byte{0xF0, 0x7E, 0xF7}, ErrTooShort},
+		{[]byte{0xF0, 0x7F, 0x00, 0x01, 0xF7}, ErrNotSysex},
+		{[]byte{0xF0, 0x7E, 0x00, 0x60, 0xF7}, ErrUnsupportedMessage},
+		{append(header[:len(header)-2:len(header)-2], 0xF7), ErrBadSize},
+		{append(header[:len(header)-1:len(header)-1], 0x00, 0xF7), ErrBadSize},
+		{badDepth, ErrUnsupportedBitDepth},
+	}
+	for _, test := range tests {
+		if _, err := Decode(test.msg); !errors.Is(err, test.err) {
+			t.Errorf("Decode(%x) -> %v, want %v", test.msg, err, test.err)
+		}
+	}
+}
+
+// Packet numbers are 7-bit. A stray high bit must be masked on decode like it is
+// when encoding.
+func TestDecodePacketNumberHighBit(t *testing.T) {
+	msg, err := Decode([]byte{0xF0, 0x7E, 0x01, 0x7F, 0x85, 0xF7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := msg.(*ControlPacket)
+	if cp.PacketNumber != 5 {
+		t.Errorf("ControlPacket number %d, want 5", cp.PacketNumber)
+	}
+	if enc := cp.Encode(nil); enc[4] != 0x05 {
+		t.Errorf("re-encoded packet number %#x, want 0x05", enc[4])
+	}
+
+	p := &DataPacket{Channel: 1, PacketNumber: 9}
+	p.Checksum = p.ComputeChecksum()
+	raw := p.Encode(nil)
+	raw[4] |= 0x80
+	msg, err = Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := msg.(*DataPacket)
+	if dp.PacketNumber != 9 {
+		t.Errorf("DataPacket number %d, want 9", dp.PacketNumber)
+	}
+	if dp.ComputeChecksum() != dp.Checksum {
+		t.Error("checksum mismatch after decode")
+	}
+}
+
+func TestSDSChecksum(t *testing.T) {
+	// 7E ^ 01 ^ 02 ^ 02 ^ 10 = 6F
+	p := &DataPacket{Channel: 1, PacketNumber: 2, Checksum: 0x55}
+	p.Data[0] = 0x10
+	if sum := SDSChecksum(p.Encode(nil)); sum != 0x6F {
+		t.Errorf("SDSChecksum = %#x, want 0x6f", sum)
+	}
+	if sum := p.ComputeChecksum(); sum != 0x6F {
+		t.Errorf("ComputeChecksum = %#x, want 0x6f", sum)
+	}
+	if sum := SDSChecksum([]byte{0xF7}); sum != 0 {
+		t.Errorf("SDSChecksum of short message = %#x", sum)
+	}
+
+	// Check against the packets of a real dump.
+	raw, err := ioutil.ReadFile("testdata/akwf1_16bit_44k.sds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := dumpHeaderSize; off+dataPacketSize <= len(raw); off += dataPacketSize {
+		msg := raw[off : off+dataPacketSize]
+		if sum := SDSChecksum(msg); sum != msg[len(msg)-2] {
+			t.Fatalf("packet at offset %d: checksum %#x, want %#x", off, sum, msg[len(msg)-2])
+		}
+	}
+}
+
+func TestControlPacketConstructors(t *testing.T) {
+	tests := []struct {
+		msg  *ControlPacket
+		want ControlPacket
+	}{
+		{NewAck(1, 2), ControlPacket{Ack, 1, 2}},
+		{NewNak(1, 2), ControlPacket{Nak, 1, 2}},
+		{NewCancel(1, 2), ControlPacket{Cancel, 1, 2}},
+		{NewWait(1, 2), ControlPacket{Wait, 1, 2}},
+	}
+	for _, test := range tests {
+		if *test.msg != test.want {
+			t.Errorf("got %+v, want %+v", *test.msg, test.want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	h := &DumpHeader{1, 2, 16, 4, 5, 6, 7, 8, 0}
+	hc := h.Clone()
+	if hc == h || *hc != *h {
+		t.Fatalf("bad header clone %+v", hc)
+	}
+	hc.Length = 100
+	if h.Length != 5 {
+		t.Fatal("modifying clone changed original header")
+	}
+
+	p := &DataPacket{1, 2, [120]byte{3, 4, 5, 6}, 7}
+	pc := p.Clone()
+	if pc == p || *pc != *p {
+		t.Fatalf("bad packet clone %+v", pc)
+	}
+	pc.Data[0] = 100
+	if p.Data[0] != 3 {
+		t.Fatal("modifying clone changed original packet")
+	}
+}
+
+func TestDumpHeaderDiff(t *testing.T) {
+	h := &DumpHeader{Channel: 1, Number: 2, BitDepth: 16, Period: 22675, Length: 600, LoopEnd: 599}
+	if d := h.Diff(h.Clone()); d != nil {
+		t.Fatalf("equal headers have diff %q", d)
+	}
+	other := h.Clone()
+	other.Length = 598
+	other.LoopEnd = 597
+	other.LoopType = LoopNone
+	want := []string{"Length 600 vs 598", "LoopEnd 599 vs 597", "LoopType 0x0 vs 0x7f"}
+	if d := h.Diff(other); !reflect.DeepEqual(d, want) {
+		t.Fatalf("wrong diff %q, want %q", d, want)
+	}
+}
+
+func TestHeaderFromIntBuffer(t *testing.T) {
+	buf := &audio.IntBuffer{
+		Data:           make([]int, 600),
+		Format:         &audio.Format{NumChannels: 1, SampleRate: 44100},
+		SourceBitDepth: 16,
+	}
+	h := HeaderFromIntBuffer(buf, 1, 2)
+	want := DumpHeader{Channel: 1, Number: 2, BitDepth: 16, Period: 22675, Length: 600}
+	if *h != want {
+		t.Fatalf("wrong header %+v", *h)
+	}
+}
+
+func TestDumpHeaderValidate(t *testing.T) {
+	h := &DumpHeader{BitDepth: 16, Period: 22675, Length: MaxLength}
+	if err := h.Validate(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	h.Length = MaxLength + 1
+	if err := h.Validate(); err == nil {
+		t.Fatal("no error for length > MaxLength")
+	}
+	h.Length = 0
+	if err := h.Validate(); !errors.Is(err, ErrEmptyWaveform) {
+		t.Fatalf("got error %v for length 0, want ErrEmptyWaveform", err)
+	}
+	h = &DumpHeader{BitDepth: 30}
+	if err := h.Validate(); err == nil {
+		t.Fatal("no error for bit depth 30")
+	}
+	h = &DumpHeader{BitDepth: 16, Period: SampleRateToPeriod(900)}
+	if err := h.Validate(); err == nil {
+		t.Fatal("no error for period of 900Hz rate")
+	}
+	h = &DumpHeader{BitDepth: 16, Period: SampleRateToPeriod(0), Length: 100}
+	if err := h.Validate(); err == nil {
+		t.Fatal("no error for zero sample rate")
+	}
+	h = &DumpHeader{BitDepth: 16, Length: MaxLength, LoopStart: 0, LoopEnd: MaxLength + 1}
+	if err := h.Validate(); err == nil {
+		t.Fatal("no error for loop end > MaxLength")
+	}
+}
+
+func TestFullScale(t *testing.T) {
+	tests := []struct {
+		bits, zero, min, max int
+	}{
+		{8, 0x80, -0x80, 0x7F},
+		{14, 0x2000, -0x2000, 0x1FFF},
+		{15, 0x4000, -0x4000, 0x3FFF},
+		{16, 0x8000, -0x8000, 0x7FFF},
+		{21, 0x100000, -0x100000, 0xFFFFF},
+		{22, 0x200000, -0x200000, 0x1FFFFF},
+		{24, 0x800000, -0x800000, 0x7FFFFF},
+		{28, 0x8000000, -0x8000000, 0x7FFFFFF},
+	}
+	for _, test := range tests {
+		if z := ZeroPoint(test.bits); z != test.zero {
+			t.Errorf("%d bits: ZeroPoint %#x, want %#x", test.bits, z, test.zero)
+		}
+		min, max := FullScale(test.bits)
+		if min != test.min || max != test.max {
+			t.Errorf("%d bits: FullScale %#x..%#x, want %#x..%#x", test.bits, min, max, test.min, test.max)
+		}
+		// The extremes must survive encoding.
+		var p DataPacket
+		p.SetSamples([]int{min, max, 0}, test.bits)
+		if got := p.GetSamplesN(nil, test.bits, 3); got[0] != min || got[1] != max || got[2] != 0 {
+			t.Errorf("%d bits: round trip of %d..%d returned %d", test.bits, min, max, got)
+		}
+	}
+}
+
+// 21 bits is the largest depth using three bytes per sample, 22 bits the smallest
+// using four. This checks that no bit is lost at the boundary.
+func TestSampleBoundary21And22Bits(t *testing.T) {
+	tests := []struct {
+		bits, count, bytes int
+	}{
+		{21, 40, 3},
+		{22, 30, 4},
+	}
+	for _, test := range tests {
+		var p DataPacket
+		if n := p.SampleCount(test.bits); n != test.count {
+			t.Fatalf("%d bits: SampleCount %d, want %d", test.bits, n, test.count)
+		}
+		// Extreme values and each single bit.
+		min, max := FullScale(test.bits)
+		samples := []int{min, max, -1, 0, 1, min + 1, max - 1}
+		for b := 0; b < test.bits-1; b++ {
+			samples = append(samples, 1<<b, -(1 << b))
+		}
+		samples = samples[:test.count]
+		p.SetSamples(samples, test.bits)
+		if got := p.GetSamples(nil, test.bits); !samplesEqual(got, samples) {
+			t.Errorf("%d bits: round trip failed\ngot  %d\nwant %d", test.bits, got, samples)
+		}
+		// The value is left-justified, unused low bits of the last byte must be zero.
+		unused := 7*test.bytes - test.bits
+		for i := 0; i < test.count; i++ {
+			last := p.Data[i*test.bytes+test.bytes-1]
+			if last&(1<<unused-1) != 0 {
+				t.Fatalf("%d bits: sample %d has unused bits set: %#x", test.bits, i, last)
+			}
+		}
+		// The maximum value is transmitted as all ones.
+		p.SetSamples([]int{max}, test.bits)
+		for i := 0; i < test.bytes; i++ {
+			want := byte(0x7F)
+			if i == test.bytes-1 {
+				want &^= 1<<unused - 1
+			}
+			if p.Data[i] != want {
+				t.Errorf("%d bits: byte %d of max value is %#x, want %#x", test.bits, i, p.Data[i], want)
+			}
+		}
+	}
+}
+
+func TestPeriodConversion(t *testing.T) {
+	if p := SampleRateToPeriod(44100); p != 22675 {
+		t.Fatalf("wrong period %d for 44100Hz", p)
+	}
+	if r := PeriodToSampleRate(20000); r != 50000 {
+		t.Fatalf("wrong rate %v for 20000ns", r)
+	}
+	if r := PeriodToSampleRate(0); r != 0 {
+		t.Fatalf("wrong rate %v for zero period", r)
+	}
+	if p := SampleRateToPeriod(0); p != 0 {
+		t.Fatalf("wrong period %d for zero rate", p)
+	}
+}
+
+func TestFormatSampleRate(t *testing.T) {
+	tests := []struct {
+		period uint
+		want   string
+	}{
+		{SampleRateToPeriod(44100), "44.1 kHz"},
+		{SampleRateToPeriod(48000), "48 kHz"},
+		{SampleRateToPeriod(11025), "11.025 kHz"},
+		{20000, "50000 Hz"},
+		{30000, "33333.33 Hz"},
+	}
+	for _, test := range tests {
+		if s := FormatSampleRate(test.period); s != test.want {
+			t.Errorf("FormatSampleRate(%d) = %q, want %q", test.period, s, test.want)
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	tests := []fixture{
 		{name: "akwf1_24bit_44k", bits: 24, rate: 44100, length: 600},
 		{name: "akwf1_16bit_44k", bits: 16, rate: 44100, length: 600},
 		{name: "akwf1_8bit_44k", bits: 8, rate: 44100, length: 600},
 	}
+	tests = append(tests, generatedFixtures...)
 
 	for _, test := range tests {
 		test := test
@@ -85,7 +386,7 @@ func TestSamples(t *testing.T) {
 			if h.BitDepth != byte(test.bits) {
 				t.Error("SDS header has wrong bit depth", h.BitDepth)
 			}
-			if h.Period != samplerateToPeriod(test.rate) {
+			if h.Period != SampleRateToPeriod(test.rate) {
 				t.Error("SDS header has wrong period", h.Period)
 			}
 			if h.Length != uint(test.length) {
@@ -97,6 +398,7 @@ func TestSamples(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			ConvertBitDepth(wavFile.samples, wavFile.bitDepth, test.bits)
 			if !samplesEqual(sdsFile.samples[:h.Length], wavFile.samples) {
 				t.Error("samples not equal")
 				t.Logf("wav (%d) %8d", len(wavFile.samples), wavFile.samples)
@@ -115,6 +417,123 @@ func TestSamples(t *testing.T) {
 	}
 }
 
+func TestSampleCount(t *testing.T) {
+	tests := []struct{ bits, count int }{
+		{8, 60}, {14, 60}, {15, 40}, {16, 40}, {21, 40}, {22, 30}, {24, 30}, {28, 30},
+	}
+	var msg DataPacket
+	for _, test := range tests {
+		if n := msg.SampleCount(test.bits); n != test.count {
+			t.Errorf("SampleCount(%d) = %d, want %d", test.bits, n, test.count)
+		}
+		if n := len(msg.GetSamples(nil, test.bits)); n != test.count {
+			t.Errorf("GetSamples returned %d samples at %d bits, want %d", n, test.bits, test.count)
+		}
+	}
+}
+
+func TestExpectedPackets(t *testing.T) {
+	tests := []struct {
+		bits    byte
+		length  uint
+		packets int
+	}{
+		{16, 0, 0}, {16, 1, 1}, {16, 40, 1}, {16, 41, 2}, {8, 600, 10}, {24, 601, 21},
+	}
+	for _, test := range tests {
+		h := &DumpHeader{BitDepth: test.bits, Length: test.length}
+		if n := ExpectedPackets(h); n != test.packets {
+			t.Errorf("ExpectedPackets(%d bits, %d samples) = %d, want %d", test.bits, test.length, n, test.packets)
+		}
+	}
+}
+
+func TestGetSamplesN(t *testing.T) {
+	for _, bits := range []int{8, 16, 24} {
+		var msg DataPacket
+		samples := make([]int, msg.SampleCount(bits))
+		for i := range samples {
+			samples[i] = i + 1
+		}
+		msg.SetSamples(samples, bits)
+		for _, n := range []int{-1, 0, 1, 7, len(samples), len(samples) + 10} {
+			want := n
+			if want < 0 {
+				want = 0
+			} else if want > len(samples) {
+				want = len(samples)
+			}
+			out := msg.GetSamplesN([]int{-1}, bits, n)
+			if len(out) != want+1 || out[0] != -1 || !samplesEqual(out[1:], samples[:want]) {
+				t.Errorf("GetSamplesN(%d bits, n=%d) -> %d", bits, n, out)
+			}
+		}
+	}
+}
+
+// This checks that GetSamplesInto writes only the samples of the packet and
+// stops when dst is full.
+func TestGetSamplesInto(t *testing.T) {
+	var msg DataPacket
+	samples := testWaveform(40)
+	msg.SetSamples(samples, 16)
+
+	dst := make([]int, 50)
+	if n := msg.GetSamplesInto(dst[5:], 16); n != 40 {
+		t.Fatalf("wrote %d samples, want 40", n)
+	}
+	if !samplesEqual(dst[5:45], samples) || dst[45] != 0 {
+		t.Fatalf("wrong samples %d", dst)
+	}
+	short := make([]int, 10)
+	if n := msg.GetSamplesInto(short, 16); n != 10 || !samplesEqual(short, samples[:10]) {
+		t.Fatalf("wrote %d samples %d, want first 10", n, short)
+	}
+}
+
+// This checks that the 16-bit fast path matches the generic implementation.
+func TestSamples16bit(t *testing.T) {
+	samples := make([]int, 100)
+	for i := range samples {
+		samples[i] = mrand.Intn(65536) - 32768
+	}
+	samples[0], samples[1] = -32768, 32767
+	for _, n := range []int{len(samples), 40, 17, 0} {
+		var generic, fast DataPacket
+		mrand.Read(generic.Data[:])
+		mrand.Read(fast.Data[:])
+		rem1 := generic.write3(samples[:n], 16)
+		rem2 := fast.write16(samples[:n])
+		if generic.Data != fast.Data || len(rem1) != len(rem2) {
+			t.Fatalf("write16 output differs for %d samples", n)
+		}
+		if !samplesEqual(generic.read3(nil, 16, 40), fast.read16(nil, 40)) {
+			t.Fatalf("read16 output differs for %d samples", n)
+		}
+	}
+}
+
+func TestGetSamplesInt16(t *testing.T) {
+	for _, bits := range []int{8, 10, 12, 14, 15, 16} {
+		var msg DataPacket
+		mrand.Read(msg.Data[:])
+		for i := range msg.Data {
+			msg.Data[i] &= 0x7F
+		}
+		want := msg.GetSamples(nil, bits)
+		ConvertBitDepth(want, bits, 16)
+		got := msg.GetSamplesInt16([]int16{1}, bits)
+		if len(got) != len(want)+1 || got[0] != 1 {
+			t.Fatalf("%d bits: wrong output length %d", bits, len(got))
+		}
+		for i := range want {
+			if int(got[i+1]) != want[i] {
+				t.Fatalf("%d bits: sample %d is %d, want %d", bits, i, got[i+1], want[i])
+			}
+		}
+	}
+}
+
 func TestSetSamplesLengths(t *testing.T) {
 	var msg DataPacket
 	mrand.Read(msg.Data[:])
@@ -154,18 +573,22 @@ func TestSetSamplesLengths(t *testing.T) {
 }
 
 func encodeSDS(samples []int, sampleRate, bitDepth int) []byte {
-	h := &DumpHeader{BitDepth: byte(bitDepth), Period: samplerateToPeriod(sampleRate)}
-	send := NewSendOp(samples, h)
-	output := h.Encode(nil)
-	for !send.Done() {
-		output = send.NextMessage().Encode(output)
+	buf := &audio.IntBuffer{
+		Data:           samples,
+		Format:         &audio.Format{NumChannels: 1, SampleRate: sampleRate},
+		SourceBitDepth: bitDepth,
+	}
+	h := HeaderFromIntBuffer(buf, 0, 0)
+	var output []byte
+	for _, msg := range NewSendOp(samples, h).AllMessages() {
+		output = msg.Encode(output)
 	}
 	return output
 }
 
 type sdsFile struct {
 	header  *DumpHeader
-	samples []int  // decoded sample data
+	samples []int  // decoded sample data, without padding
 	raw     []byte // content of .sds file
 }
 
@@ -176,9 +599,10 @@ func loadSDS(file string) (*sdsFile, error) {
 	}
 
 	r := &sdsFile{raw: raw}
-	reader := bufio.NewReader(bytes.NewReader(raw))
+	dec := NewDecoder(bytes.NewReader(raw))
+	var packets, pos int
 	for i := 0; ; i++ {
-		msg, err := readMessage(reader)
+		msg, err := dec.ReadMessage()
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -191,29 +615,25 @@ func loadSDS(file string) (*sdsFile, error) {
 				return r, fmt.Errorf("msg %d: extra header", i)
 			}
 			r.header = msg
+			r.samples = make([]int, msg.Length)
 		case *DataPacket:
 			if r.header == nil {
 				return r, fmt.Errorf("data packet before header")
 			}
-			if cs := msg.ComputeChecksum(); cs != msg.Checksum {
-				return r, fmt.Errorf("msg %d: checksum %x != %x", i, cs, msg.Checksum)
-			}
-			r.samples = msg.GetSamples(r.samples, int(r.header.BitDepth))
+			pos += msg.GetSamplesInto(r.samples[pos:], int(r.header.BitDepth))
+			packets++
 		}
 	}
-	return r, nil
-}
-
-func readMessage(r *bufio.Reader) (Message, error) {
-	rawmsg, err := r.ReadBytes(0xF7)
-	if err != nil {
-		return nil, err
+	r.samples = r.samples[:pos]
+	if r.header != nil && packets != ExpectedPackets(r.header) {
+		return r, fmt.Errorf("file has %d packets, want %d", packets, ExpectedPackets(r.header))
 	}
-	return Decode(rawmsg)
+	return r, nil
 }
 
 type wavFile struct {
-	samples []int
+	samples  []int
+	bitDepth int
 }
 
 func loadWAV(file string) (*wavFile, error) {
@@ -231,7 +651,7 @@ func loadWAV(file string) (*wavFile, error) {
 	if decoder.NumChans != 1 {
 		return nil, fmt.Errorf("file has %d channels, want mono", decoder.NumChans)
 	}
-	r := new(wavFile)
+	r := &wavFile{bitDepth: int(decoder.BitDepth)}
 	buf := audio.IntBuffer{Data: make([]int, 128)}
 	for {
 		n, err := decoder.PCMBuffer(&buf)
@@ -244,12 +664,7 @@ func loadWAV(file string) (*wavFile, error) {
 		r.samples = append(r.samples, buf.Data[:n]...)
 	}
 
-	// Fixup unsigned -> signed for 8-bit .wav to match .sds output.
-	if decoder.BitDepth == 8 {
-		for i := range r.samples {
-			r.samples[i] = r.samples[i] - 128
-		}
-	}
+	FromWAVSamples(r.samples, int(decoder.BitDepth))
 	return r, nil
 }
 
@@ -265,6 +680,240 @@ func samplesEqual(s1, s2 []int) bool {
 	return true
 }
 
-func samplerateToPeriod(rate int) uint {
-	return uint(1000000000 / rate)
+func BenchmarkDecode(b *testing.B) {
+	msg := &DataPacket{Channel: 1, PacketNumber: 2}
+	mrand.Read(msg.Data[:])
+	msg.SetSamples(make([]int, 60), 14)
+	enc := msg.Encode(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(enc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetSamples(b *testing.B) {
+	for _, bits := range []int{8, 16, 24} {
+		bits := bits
+		b.Run(fmt.Sprintf("%dbit", bits), func(b *testing.B) {
+			var msg DataPacket
+			mrand.Read(msg.Data[:])
+			for i := range msg.Data {
+				msg.Data[i] &= 0x7F
+			}
+			out := make([]int, 0, 60)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				out = msg.GetSamples(out[:0], bits)
+			}
+		})
+	}
+}
+
+// BenchmarkReassemble compares reassembling a long waveform by appending with
+// GetSamples against decoding into a preallocated slice using GetSamplesInto.
+func BenchmarkReassemble(b *testing.B) {
+	h := &DumpHeader{BitDepth: 16}
+	var packets []*DataPacket
+	for _, msg := range NewSendOp(make([]int, 200000), h).AllMessages()[1:] {
+		packets = append(packets, msg.(*DataPacket))
+	}
+
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var samples []int
+			for _, p := range packets {
+				samples = p.GetSamples(samples, 16)
+			}
+		}
+	})
+	b.Run("prealloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			samples := make([]int, h.Length)
+			pos := 0
+			for _, p := range packets {
+				pos += p.GetSamplesInto(samples[pos:], 16)
+			}
+		}
+	})
+}
+
+// Benchmark16bit compares the specialized 16-bit encoder and decoder against the
+// generic ones.
+func Benchmark16bit(b *testing.B) {
+	var msg DataPacket
+	mrand.Read(msg.Data[:])
+	for i := range msg.Data {
+		msg.Data[i] &= 0x7F
+	}
+	out := make([]int, 0, 40)
+	samples := msg.GetSamples(nil, 16)
+
+	b.Run("read3", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			out = msg.read3(out[:0], 16, 40)
+		}
+	})
+	b.Run("read16", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			out = msg.read16(out[:0], 40)
+		}
+	})
+	b.Run("write3", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msg.write3(samples, 16)
+		}
+	})
+	b.Run("write16", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msg.write16(samples)
+		}
+	})
+}
+
+// BenchmarkGetSamplesInt16 compares GetSamplesInt16 against decoding with GetSamples
+// and converting the result.
+func BenchmarkGetSamplesInt16(b *testing.B) {
+	var msg DataPacket
+	mrand.Read(msg.Data[:])
+	for i := range msg.Data {
+		msg.Data[i] &= 0x7F
+	}
+	out := make([]int16, 0, 60)
+	buf := make([]int, 0, 60)
+
+	b.Run("direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			out = msg.GetSamplesInt16(out[:0], 12)
+		}
+	})
+	b.Run("convert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buf = msg.GetSamples(buf[:0], 12)
+			out = out[:0]
+			for _, s := range buf {
+				out = append(out, int16(s<<4))
+			}
+		}
+	})
+}
+
+// BenchmarkGetSamplesAppend measures decoding of a large dump into a single slice.
+func BenchmarkGetSamplesAppend(b *testing.B) {
+	var msg DataPacket
+	mrand.Read(msg.Data[:])
+	for i := range msg.Data {
+		msg.Data[i] &= 0x7F
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []int
+		for p := 0; p < 1000; p++ {
+			out = msg.GetSamples(out, 16)
+		}
+	}
+}
+
+func TestDecodeUnterminated(t *testing.T) {
+	msgs := []Message{
+		&DumpHeader{1, 2, 16, 4, 5, 6, 7, 8, 0},
+		&DumpRequest{1, 2},
+		&DataPacket{1, 2, [120]byte{3, 4, 5, 6}, 7},
+		&ControlPacket{Ack, 1, 8},
+		&FileDataPacket{1, 2, []byte{3, 4, 0xFF}, 5},
+	}
+	for _, msg := range msgs {
+		enc := msg.Encode(nil)
+		unterminated := enc[:len(enc)-1]
+
+		// Terminated messages decode the same in both modes.
+		dec, err := DecodeUnterminated(enc)
+		if err != nil {
+			t.Fatalf("%T: %v", msg, err)
+		}
+		if !reflect.DeepEqual(dec, msg) {
+			t.Errorf("%T: wrong decoded message %+v", msg, dec)
+		}
+
+		// Only the lenient mode accepts the message without F7.
+		if _, err := Decode(unterminated); !errors.Is(err, ErrNotSysex) {
+			t.Errorf("%T: Decode returned %v for unterminated message", msg, err)
+		}
+		dec, err = DecodeUnterminated(unterminated)
+		if err != nil {
+			t.Fatalf("%T: unterminated: %v", msg, err)
+		}
+		if !reflect.DeepEqual(dec, msg) {
+			t.Errorf("%T: wrong decoded unterminated message %+v", msg, dec)
+		}
+		// Truncated messages are rejected.
+		if _, err := DecodeUnterminated(enc[:len(enc)-2]); err == nil {
+			t.Errorf("%T: no error for truncated message", msg)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add((&DumpHeader{1, 2, 16, 4, 5, 6, 7, 8, 0}).Encode(nil))
+	f.Add((&DumpRequest{1, 2}).Encode(nil))
+	f.Add((&DataPacket{1, 2, [120]byte{3, 4, 5, 6}, 7}).Encode(nil))
+	f.Add((&ControlPacket{Ack, 1, 8}).Encode(nil))
+	f.Add((&FileDumpHeader{1, 2, "BIN ", 3, "file"}).Encode(nil))
+	f.Add((&FileDataPacket{1, 2, []byte{3, 4, 0xFF}, 5}).Encode(nil))
+	f.Add([]byte{})
+	f.Add([]byte{0xF7})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		msg, err := Decode(input)
+		if err != nil {
+			return
+		}
+		enc := msg.Encode(nil)
+		if _, err := Decode(enc); err != nil {
+			t.Fatalf("re-encoded %T %x not accepted: %v", msg, enc, err)
+		}
+	})
+}
+
+func TestSamplesRoundTripExtremes(t *testing.T) {
+	for _, bits := range []int{8, 14, 16, 21, 24, 28} {
+		var (
+			max   = 1<<(bits-1) - 1
+			min   = -1 << (bits - 1)
+			input = []int{max, min, 0, -1, 1, max - 1, min + 1}
+			msg   DataPacket
+		)
+		msg.SetSamples(input, bits)
+		output := msg.GetSamples(nil, bits)[:len(input)]
+		if !samplesEqual(input, output) {
+			t.Errorf("%d bits: round trip mismatch\n got %d\nwant %d", bits, output, input)
+		}
+	}
+}
+
+func TestMatchChannel(t *testing.T) {
+	tests := []struct {
+		ch, got byte
+		want    bool
+	}{
+		{1, 1, true},
+		{1, 2, false},
+		{BroadcastChannel, 2, true},
+		{BroadcastChannel, BroadcastChannel, true},
+		{2, BroadcastChannel, false},
+	}
+	for _, test := range tests {
+		if got := MatchChannel(test.ch, test.got); got != test.want {
+			t.Errorf("MatchChannel(%d, %d) = %t", test.ch, test.got, got)
+		}
+	}
 }
@@ -0,0 +1,493 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by transfers.
+var (
+	ErrDenied  = errors.New("transfer denied")    // the other side responded with NAK or CANCEL
+	ErrTimeout = errors.New("transfer timed out") // the other side stopped responding
+)
+
+var (
+	errNoResponse  = fmt.Errorf("%w: receiver did not respond to header", ErrTimeout)
+	errWaitExpired = fmt.Errorf("%w: receiver did not respond after WAIT", ErrTimeout)
+	errNak         = errors.New("NAK received")
+)
+
+// NakError is returned by Run when the receiver rejected a data packet too many times.
+// It wraps ErrDenied.
+type NakError struct {
+	Packet byte // packet number
+	Count  int  // number of consecutive NAKs
+}
+
+func (e *NakError) Error() string {
+	return fmt.Sprintf("%v: packet %d rejected %d times", ErrDenied, e.Packet, e.Count)
+}
+
+func (e *NakError) Unwrap() error {
+	return ErrDenied
+}
+
+// Run performs the transfer over t.
+//
+// Receivers that don't respond to the DumpHeader are treated as non-handshaking,
+// i.e. packets are sent without waiting for acknowledgement. When the receiver is
+// handshaking, the next packet is only sent after the receiver has acknowledged
+// the previous one. Packets rejected with NAK are resent, up to cfg.NakRetries
+// times.
+//
+// With cfg.Probe, the receiver is sent a DumpRequest for the slot first. A
+// receiver that handles it may start a dump of the slot, which Run cancels
+// right away. When the probe gets no response, the packets are sent right after
+// the header, without waiting for one.
+//
+// Empty waveforms can't be transferred, Run returns ErrEmptyWaveform for them
+// without sending anything.
+//
+// When the header is sent on BroadcastChannel, Run accepts responses on any
+// channel. The channel of the first response is adopted for the rest of the
+// transfer, i.e. later messages are sent on it and responses on other channels are
+// ignored.
+//
+// The transfer is aborted when ctx is cancelled. In that case, the receiver is
+// sent a CANCEL message and the context error is returned.
+func (s *SendOp) Run(ctx context.Context, t Transport, cfg *TransferConfig) error {
+	c := cfg.withDefaults()
+	cfg = &c
+	defer s.setWaiting(false)
+	err := s.run(ctx, t, cfg)
+	if err != nil && ctx.Err() != nil {
+		var packet byte
+		s.mu.Lock()
+		if s.pos > 0 {
+			packet = (s.num - 1) & 0x7F // last sent packet
+		}
+		s.mu.Unlock()
+		cfg.logf(">> CANCEL")
+		t.Send(NewCancel(s.channel, packet))
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *SendOp) run(ctx context.Context, t Transport, cfg *TransferConfig) error {
+	if s.length == 0 {
+		return ErrEmptyWaveform
+	}
+	if cfg.ResumeFrom > 0 {
+		if err := s.Seek(cfg.ResumeFrom); err != nil {
+			return fmt.Errorf("can't resume: %v", err)
+		}
+		cfg.logf("resuming transfer at packet %d", cfg.ResumeFrom)
+		return s.sendData(ctx, t, cfg, true)
+	}
+
+	handshaking := false
+	if cfg.Probe {
+		var err error
+		if handshaking, err = s.probe(ctx, t, cfg); err != nil {
+			return err
+		}
+		if handshaking {
+			cfg.logf("receiver mode: handshaking")
+		} else {
+			cfg.logf("receiver mode: non-handshaking")
+		}
+	}
+
+	// Begin transfer by sending header.
+	cfg.logf("requesting transfer")
+	if err := t.Send(s.header); err != nil {
+		return err
+	}
+	if cfg.Probe && !handshaking {
+		// The probe already waited for a response, don't wait again.
+		return s.sendData(ctx, t, cfg, false)
+	}
+
+	var (
+		waiting = false
+		waitEnd time.Time
+		retries = cfg.HeaderRetries
+	)
+	for {
+		timeout := cfg.HandshakeTimeout
+		if waiting {
+			timeout = time.Until(waitEnd)
+		} else if retries > 0 {
+			timeout = cfg.HeaderRetryTimeout
+		}
+		msg, err := receiveTimeout(ctx, t, timeout)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			if waiting {
+				return errWaitExpired
+			}
+			if retries > 0 {
+				retries--
+				cfg.logf("receiver did not respond, resending header")
+				if err := t.Send(s.header); err != nil {
+					return err
+				}
+				continue
+			}
+			if handshaking {
+				return errNoResponse
+			}
+			cfg.logf("receiver did not respond, assumed to be non-handshaking")
+			return s.sendData(ctx, t, cfg, false)
+		case *ControlPacket:
+			if !s.acceptChannel(cfg, msg.Channel) {
+				continue
+			}
+			waiting = false
+			s.setWaiting(false)
+			switch msg.Type {
+			case Ack:
+				if msg.PacketNumber != 0 {
+					continue
+				}
+				cfg.logf("<< ACK")
+				if err := sleep(ctx, cfg.FirstPacketDelay); err != nil {
+					return err
+				}
+				return s.sendData(ctx, t, cfg, true)
+			case Nak:
+				return fmt.Errorf("%w: NAK response", ErrDenied)
+			case Cancel:
+				return fmt.Errorf("%w: CANCEL response", ErrDenied)
+			case Wait:
+				cfg.logf("<< WAIT")
+				waiting = true
+				// Later WAITs don't extend the deadline, or a receiver that
+				// keeps sending them would stall the transfer forever.
+				if waitEnd.IsZero() {
+					waitEnd = time.Now().Add(cfg.HeaderWaitTimeout)
+				}
+				s.setWaiting(true)
+			}
+		default:
+			cfg.logf("ignoring message %#v", msg)
+		}
+	}
+}
+
+// probe checks whether the receiver supports handshaking. It sends a DumpRequest
+// and reports whether any response arrives.
+func (s *SendOp) probe(ctx context.Context, t Transport, cfg *TransferConfig) (bool, error) {
+	cfg.logf("probing receiver")
+	if err := t.Send(&DumpRequest{Channel: s.channel, Number: s.header.Number}); err != nil {
+		return false, err
+	}
+	for {
+		msg, err := receiveTimeout(ctx, t, cfg.HandshakeTimeout)
+		if err != nil {
+			return false, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			return false, nil
+		case *DumpHeader:
+			if !s.acceptChannel(cfg, msg.Channel) {
+				continue
+			}
+			// The receiver started a dump of the slot, stop it.
+			cfg.logf("<< DumpHeader, cancelling")
+			return true, t.Send(NewCancel(s.channel, 0))
+		case *ControlPacket:
+			if !s.acceptChannel(cfg, msg.Channel) {
+				continue
+			}
+			return true, nil
+		}
+	}
+}
+
+// ProbeBitDepth checks whether the receiver accepts waveforms of the given bit depth.
+// It sends a DumpHeader for a one-sample waveform in the slot of h and reports
+// whether the receiver acknowledges it. An accepted probe is cancelled right away.
+//
+// SDS has no way to query the capabilities of a device, so this is a heuristic. It
+// relies on the receiver rejecting headers it can't handle with NAK. When the
+// receiver doesn't respond at all, the returned error wraps ErrTimeout. Note that
+// some devices may clear the slot when they accept the header.
+func ProbeBitDepth(ctx context.Context, t Transport, h *DumpHeader, bitDepth int, cfg *TransferConfig) (bool, error) {
+	c := cfg.withDefaults()
+	cfg = &c
+	probe := &DumpHeader{
+		Channel:  h.Channel,
+		Number:   h.Number,
+		BitDepth: byte(bitDepth),
+		Period:   h.Period,
+		Length:   1,
+		LoopType: LoopNone,
+	}
+	cfg.logf("probing %d-bit support", bitDepth)
+	var (
+		accepted bool
+		channel  byte
+	)
+	answered, err := Exchange(ctx, t, probe, h.Channel, cfg, func(cp *ControlPacket, _ time.Duration) bool {
+		switch cp.Type {
+		case Ack:
+			accepted, channel = true, cp.Channel
+			return true
+		case Nak, Cancel:
+			return true
+		}
+		return false
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case !answered:
+		return false, errNoResponse
+	case accepted:
+		return true, t.Send(NewCancel(channel, 0))
+	default:
+		return false, nil
+	}
+}
+
+// Exchange transmits msg and passes the control packets that the receiver sends back
+// on channel ch to fn, along with the time since msg was sent. See MatchChannel for
+// how ch is matched. Exchange stops when fn returns true, or when the receiver is
+// silent for cfg.HandshakeTimeout. After the first WAIT response, the exchange may
+// last for cfg.HeaderWaitTimeout more, further responses don't extend it. The result
+// reports whether fn ended the exchange, it is false when the receiver went silent.
+func Exchange(ctx context.Context, t Transport, msg Message, ch byte, cfg *TransferConfig, fn func(cp *ControlPacket, d time.Duration) bool) (bool, error) {
+	c := cfg.withDefaults()
+	if err := t.Send(msg); err != nil {
+		return false, err
+	}
+	var (
+		start   = time.Now()
+		timeout = c.HandshakeTimeout
+		waitEnd time.Time
+	)
+	for {
+		msg, err := receiveTimeout(ctx, t, timeout)
+		if err != nil {
+			return false, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			return false, nil
+		case *ControlPacket:
+			if !MatchChannel(ch, msg.Channel) {
+				continue
+			}
+			if fn(msg, time.Since(start)) {
+				return true, nil
+			}
+			timeout = c.HandshakeTimeout
+			if msg.Type == Wait {
+				if waitEnd.IsZero() {
+					waitEnd = time.Now().Add(c.HeaderWaitTimeout)
+				}
+				timeout = time.Until(waitEnd)
+			} else if !waitEnd.IsZero() && time.Until(waitEnd) < timeout {
+				timeout = time.Until(waitEnd)
+			}
+		}
+	}
+}
+
+// sendData transmits the data packets. When the receiver is handshaking, each packet
+// is sent as soon as the previous one is acknowledged. Otherwise, packets are spaced
+// by the configured packet delay.
+func (s *SendOp) sendData(ctx context.Context, t Transport, cfg *TransferConfig, handshaking bool) error {
+	wait := cfg.AckTimeout
+	if !handshaking {
+		wait = cfg.PacketDelay
+	}
+	var (
+		progress  int
+		lastSent  *DataPacket
+		confirmed bool
+	)
+	for !s.Done() {
+		p := s.NextMessage().(*DataPacket)
+		lastSent = p
+		var err error
+		if confirmed, err = s.sendPacket(ctx, t, cfg, p, wait); err != nil {
+			return err
+		}
+
+		if cfg.OnProgress != nil {
+			st := s.Status()
+			cfg.OnProgress(st.Sent, st.Total)
+		} else if pct := s.Progress(); pct-progress > 5 || (pct == 100 && progress != 100) {
+			progress = pct
+			cfg.logf("progress: %d%%", progress)
+		}
+	}
+
+	if cfg.Confirm && !confirmed && lastSent != nil {
+		var err error
+		confirmed, err = s.awaitAck(ctx, t, cfg, lastSent.PacketNumber, cfg.ConfirmTimeout)
+		if err == errNak {
+			confirmed, err = s.sendPacket(ctx, t, cfg, lastSent, cfg.ConfirmTimeout)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.confirmed = confirmed
+	s.mu.Unlock()
+	if confirmed {
+		cfg.logf("transfer confirmed by receiver")
+	} else {
+		cfg.logf("transfer sent, unconfirmed")
+	}
+	return s.sendLoops(t, cfg)
+}
+
+// sendPacket transmits a data packet and waits for its acknowledgement. The packet
+// is resent when the receiver responds with NAK. If the receiver keeps rejecting it,
+// the transfer is cancelled.
+func (s *SendOp) sendPacket(ctx context.Context, t Transport, cfg *TransferConfig, p *DataPacket, timeout time.Duration) (bool, error) {
+	for naks := 0; ; naks++ {
+		if naks > 0 {
+			cfg.logf("<< NAK for packet %d, resending", p.PacketNumber)
+		}
+		if err := t.Send(p); err != nil {
+			return false, err
+		}
+		acked, err := s.awaitAck(ctx, t, cfg, p.PacketNumber, timeout)
+		if err != errNak {
+			return acked, err
+		}
+		if naks >= cfg.NakRetries {
+			cfg.logf(">> CANCEL")
+			if err := t.Send(NewCancel(s.channel, p.PacketNumber)); err != nil {
+				return false, err
+			}
+			return false, &NakError{Packet: p.PacketNumber, Count: naks + 1}
+		}
+	}
+}
+
+// sendLoops transmits the additional loops.
+func (s *SendOp) sendLoops(t Transport, cfg *TransferConfig) error {
+	for _, loop := range cfg.Loops {
+		loop.Channel = s.channel
+		loop.Number = s.header.Number
+		cfg.logf(">> LoopPoint %d: %d-%d", loop.Loop, loop.Start, loop.End)
+		if err := t.Send(&loop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitAck waits for the receiver to acknowledge a packet. It returns false if
+// no acknowledgement arrives within the timeout, and errNak if the receiver rejects
+// the packet. ACKs for other packets are ignored. When the receiver sends WAIT,
+// awaitAck waits until it sends another message.
+func (s *SendOp) awaitAck(ctx context.Context, t Transport, cfg *TransferConfig, packet byte, timeout time.Duration) (bool, error) {
+	var (
+		deadline = time.Now().Add(timeout)
+		waiting  = false
+	)
+	defer s.setWaiting(false)
+	for {
+		var msg Message
+		var err error
+		if waiting {
+			msg, err = t.Receive(ctx)
+		} else {
+			msg, err = receiveTimeout(ctx, t, time.Until(deadline))
+		}
+		if err != nil {
+			return false, err
+		}
+		switch msg := msg.(type) {
+		case nil:
+			return false, nil
+		case *ControlPacket:
+			if !s.acceptChannel(cfg, msg.Channel) {
+				continue
+			}
+			waiting = false
+			s.setWaiting(false)
+			switch msg.Type {
+			case Ack:
+				if msg.PacketNumber == packet {
+					return true, nil
+				}
+				cfg.logf("ignoring ACK for packet %d, waiting for %d", msg.PacketNumber, packet)
+			case Nak:
+				if msg.PacketNumber == packet {
+					return false, errNak
+				}
+				cfg.logf("ignoring NAK for packet %d, waiting for %d", msg.PacketNumber, packet)
+			case Cancel:
+				return false, fmt.Errorf("%w: cancelled by receiver", ErrDenied)
+			case Wait:
+				cfg.logf("<< WAIT")
+				waiting = true
+				s.setWaiting(true)
+			}
+		}
+	}
+}
+
+// Confirmed reports whether the receiver acknowledged the final packet of the
+// transfer performed by Run.
+func (s *SendOp) Confirmed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.confirmed
+}
+
+// acceptChannel reports whether a response on the given channel belongs to the
+// transfer. If the transfer was started on BroadcastChannel, the channel of the
+// first response is adopted.
+func (s *SendOp) acceptChannel(cfg *TransferConfig, ch byte) bool {
+	if !MatchChannel(s.channel, ch) {
+		return false
+	}
+	if ch != s.channel {
+		cfg.logf("receiver responded on channel %d, using it for the transfer", ch)
+		s.channel = ch
+	}
+	return true
+}
+
+// sleep pauses for the given duration, or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receiveTimeout waits for a message from t. It returns a nil message if no
+// message arrives within the timeout.
+func receiveTimeout(ctx context.Context, t Transport, timeout time.Duration) (Message, error) {
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	msg, err := t.Receive(tctx)
+	if err != nil && ctx.Err() == nil && tctx.Err() != nil {
+		return nil, nil
+	}
+	return msg, err
+}
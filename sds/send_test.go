@@ -0,0 +1,647 @@
+package sds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fjl/sds/internal/sdstest"
+)
+
+// mockReceiver is a Transport that simulates a receiving device.
+type mockReceiver = sdstest.Receiver[Message]
+
+var newMockReceiver = sdstest.NewReceiver[Message]
+
+func testWaveform(n int) []int {
+	samples := make([]int, n)
+	for i := range samples {
+		samples[i] = i
+	}
+	return samples
+}
+
+func TestRunHandshake(t *testing.T) {
+	var packets int
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			packets++
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(400), &DumpHeader{Channel: 1, BitDepth: 16})
+	if err := op.Run(context.Background(), r, new(TransferConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if packets != 10 {
+		t.Fatalf("receiver got %d packets, want 10", packets)
+	}
+	if !op.Confirmed() {
+		t.Fatal("transfer not confirmed")
+	}
+}
+
+func TestRunBroadcastChannel(t *testing.T) {
+	const deviceChannel = 5
+	var channels []byte
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(deviceChannel, 0), 0)
+		case *DataPacket:
+			channels = append(channels, msg.Channel)
+			// A response from another device must not be taken for the receiver's.
+			r.Respond(NewNak(3, msg.PacketNumber), 0)
+			r.Respond(NewAck(deviceChannel, msg.PacketNumber), 0)
+		case *LoopPoint:
+			channels = append(channels, msg.Channel)
+		}
+	})
+	cfg := &TransferConfig{Loops: []LoopPoint{{Loop: 1, Start: 0, End: 10}}}
+	op := NewSendOp(testWaveform(200), &DumpHeader{Channel: BroadcastChannel, BitDepth: 16})
+	if err := op.Run(context.Background(), r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !op.Confirmed() {
+		t.Fatal("transfer not confirmed")
+	}
+	want := []byte{deviceChannel, deviceChannel, deviceChannel, deviceChannel, deviceChannel, deviceChannel}
+	if !bytes.Equal(channels, want) {
+		t.Fatalf("messages sent on channels %d, want %d", channels, want)
+	}
+}
+
+// This checks that independent transfers can run concurrently with a shared
+// configuration, as done by sds-send for multiple devices.
+func TestRunConcurrent(t *testing.T) {
+	var (
+		cfg     = &TransferConfig{Loops: []LoopPoint{{Loop: 1, Start: 0, End: 10}}}
+		samples = testWaveform(1000)
+		wg      sync.WaitGroup
+		errs    = make([]error, 4)
+	)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newMockReceiver(func(r *mockReceiver, msg Message) {
+				switch msg := msg.(type) {
+				case *DumpHeader:
+					r.Respond(NewAck(msg.Channel, 0), 0)
+				case *DataPacket:
+					r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+				}
+			})
+			op := NewSendOp(samples, &DumpHeader{Channel: byte(i), Number: uint16(i), BitDepth: 16})
+			errs[i] = op.Run(context.Background(), r, cfg)
+			if errs[i] == nil && !op.Confirmed() {
+				errs[i] = errors.New("not confirmed")
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("transfer %d: %v", i, err)
+		}
+	}
+}
+
+func TestRunProgress(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	var calls [][2]int
+	cfg := &TransferConfig{OnProgress: func(sent, total int) {
+		calls = append(calls, [2]int{sent, total})
+	}}
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	if err := op.Run(context.Background(), r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]int{{1, 3}, {2, 3}, {3, 3}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("OnProgress calls %v, want %v", calls, want)
+	}
+}
+
+func TestSendOpStatus(t *testing.T) {
+	// The receiver sends WAIT for packet 2 and continues when the test
+	// has observed the WAIT state.
+	resume := make(chan struct{})
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			if msg.PacketNumber == 2 {
+				r.Respond(NewWait(msg.Channel, 2), 0)
+				go func() {
+					<-resume
+					r.Respond(NewAck(msg.Channel, 2), 0)
+				}()
+				return
+			}
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(400), &DumpHeader{Channel: 1, BitDepth: 16})
+	errc := make(chan error, 1)
+	go func() { errc <- op.Run(context.Background(), r, new(TransferConfig)) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st := op.Status()
+		if st.Waiting {
+			if st.Sent != 3 || st.Total != 10 || st.Done {
+				t.Errorf("wrong status while waiting: %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WAIT state not observed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(resume)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	want := TransferStatus{Sent: 10, Total: 10, Progress: 100, Done: true}
+	if st := op.Status(); st != want {
+		t.Fatalf("final status %+v, want %+v", st, want)
+	}
+}
+
+func TestRunEmpty(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {})
+	op := NewSendOp(nil, &DumpHeader{Channel: 1, BitDepth: 16})
+	if !op.Done() || op.Progress() != 100 {
+		t.Fatalf("empty op: Done %t, Progress %d", op.Done(), op.Progress())
+	}
+	if err := op.Run(context.Background(), r, new(TransferConfig)); !errors.Is(err, ErrEmptyWaveform) {
+		t.Fatalf("got error %v, want ErrEmptyWaveform", err)
+	}
+	if len(r.Received()) != 0 {
+		t.Fatalf("receiver got %d messages, want none", len(r.Received()))
+	}
+}
+
+func TestRunStaleAck(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		ack1Sent  bool
+		early     bool
+		ack1Delay = 5 * time.Millisecond
+	)
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			switch msg.PacketNumber {
+			case 1:
+				// ACK an earlier packet, then the right one.
+				r.Respond(NewAck(msg.Channel, 0), 0)
+				time.AfterFunc(ack1Delay, func() {
+					mu.Lock()
+					ack1Sent = true
+					mu.Unlock()
+					r.Respond(NewAck(msg.Channel, 1), 0)
+				})
+			case 2:
+				mu.Lock()
+				early = !ack1Sent
+				mu.Unlock()
+				r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+			default:
+				r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+			}
+		}
+	})
+	op := NewSendOp(testWaveform(200), &DumpHeader{Channel: 1, BitDepth: 16})
+	if err := op.Run(context.Background(), r, new(TransferConfig)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if early {
+		t.Fatal("packet 2 sent before packet 1 was acknowledged")
+	}
+}
+
+func TestRunDenied(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if h, ok := msg.(*DumpHeader); ok {
+			r.Respond(NewNak(h.Channel, 0), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	err := op.Run(context.Background(), r, new(TransferConfig))
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("got error %v, want ErrDenied", err)
+	}
+}
+
+func TestRunNakResend(t *testing.T) {
+	var naked bool
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			// Reject packet 1 once.
+			if msg.PacketNumber == 1 && !naked {
+				naked = true
+				r.Respond(NewNak(msg.Channel, msg.PacketNumber), 0)
+				return
+			}
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(120), &DumpHeader{Channel: 1, BitDepth: 16})
+	if err := op.Run(context.Background(), r, new(TransferConfig)); err != nil {
+		t.Fatal(err)
+	}
+	// Header, packets 0, 1, 1, 2.
+	if len(r.Received()) != 5 {
+		t.Fatalf("receiver got %d messages, want 5", len(r.Received()))
+	}
+}
+
+func TestRunNakGiveUp(t *testing.T) {
+	// The receiver rejects every data packet.
+	var packets int
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			packets++
+			r.Respond(NewNak(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	err := op.Run(context.Background(), r, &TransferConfig{NakRetries: 2})
+	var nerr *NakError
+	if !errors.As(err, &nerr) || nerr.Packet != 0 || nerr.Count != 3 {
+		t.Fatalf("got error %v, want NakError for packet 0", err)
+	}
+	if !errors.Is(err, ErrDenied) {
+		t.Fatal("NakError does not wrap ErrDenied")
+	}
+	if packets != 3 {
+		t.Fatalf("packet sent %d times, want 3", packets)
+	}
+	last := r.Received()[len(r.Received())-1]
+	if cp, ok := last.(*ControlPacket); !ok || cp.Type != Cancel {
+		t.Fatalf("last message is %#v, want CANCEL", last)
+	}
+}
+
+func TestRunNoRetries(t *testing.T) {
+	var packets int
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			packets++
+			r.Respond(NewNak(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	err := op.Run(context.Background(), r, &TransferConfig{NakRetries: NoRetries})
+	var nerr *NakError
+	if !errors.As(err, &nerr) || nerr.Count != 1 {
+		t.Fatalf("got error %v, want NakError with count 1", err)
+	}
+	if packets != 1 {
+		t.Fatalf("packet sent %d times, want 1", packets)
+	}
+}
+
+// This checks that a NAK for a packet other than the one just sent doesn't trigger
+// a resend.
+func TestRunNakOtherPacket(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			if msg.PacketNumber == 1 {
+				r.Respond(NewNak(msg.Channel, 0), 0)
+			}
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(120), &DumpHeader{Channel: 1, BitDepth: 16})
+	if err := op.Run(context.Background(), r, new(TransferConfig)); err != nil {
+		t.Fatal(err)
+	}
+	// Header, packets 0, 1, 2.
+	if len(r.Received()) != 4 {
+		t.Fatalf("receiver got %d messages, want 4", len(r.Received()))
+	}
+}
+
+func TestExchange(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		r.Respond(NewNak(2, 0), 0) // other channel
+		r.Respond(&DumpHeader{Channel: 1}, 0)
+		r.Respond(NewWait(1, 0), 0)
+		r.Respond(NewAck(1, 0), 0)
+		r.Respond(NewNak(1, 0), 0) // after fn is done
+	})
+	var got []ControlPacketType
+	cfg := &TransferConfig{HandshakeTimeout: 50 * time.Millisecond}
+	answered, err := Exchange(context.Background(), r, NewCancel(1, 0), 1, cfg, func(cp *ControlPacket, _ time.Duration) bool {
+		got = append(got, cp.Type)
+		return cp.Type == Ack
+	})
+	if err != nil || !answered {
+		t.Fatalf("Exchange returned %t, %v", answered, err)
+	}
+	if want := []ControlPacketType{Wait, Ack}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("fn got %v, want %v", got, want)
+	}
+	if n := len(r.Received()); n != 1 {
+		t.Fatalf("receiver got %d messages, want 1", n)
+	}
+}
+
+func TestExchangeBroadcast(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		r.Respond(NewAck(5, 0), 0)
+	})
+	var channel byte
+	cfg := &TransferConfig{HandshakeTimeout: 50 * time.Millisecond}
+	answered, err := Exchange(context.Background(), r, NewCancel(BroadcastChannel, 0), BroadcastChannel, cfg, func(cp *ControlPacket, _ time.Duration) bool {
+		channel = cp.Channel
+		return true
+	})
+	if err != nil || !answered || channel != 5 {
+		t.Fatalf("Exchange returned %t, %v, response on channel %d", answered, err, channel)
+	}
+}
+
+func TestExchangeSilent(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		r.Respond(NewNak(1, 0), 0)
+	})
+	var calls int
+	cfg := &TransferConfig{HandshakeTimeout: 20 * time.Millisecond}
+	answered, err := Exchange(context.Background(), r, NewCancel(1, 0), 1, cfg, func(cp *ControlPacket, _ time.Duration) bool {
+		calls++
+		return false
+	})
+	if err != nil || answered {
+		t.Fatalf("Exchange returned %t, %v", answered, err)
+	}
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Exchange(ctx, r, NewCancel(1, 0), 1, cfg, func(*ControlPacket, time.Duration) bool { return false }); err != context.Canceled {
+		t.Fatalf("got error %v for cancelled context", err)
+	}
+}
+
+func TestExchangeWaitRepeated(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		for i := 1; i <= 20; i++ {
+			r.Respond(NewWait(1, 0), time.Duration(i)*10*time.Millisecond)
+		}
+	})
+	cfg := &TransferConfig{HandshakeTimeout: 20 * time.Millisecond, HeaderWaitTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	answered, err := Exchange(context.Background(), r, NewCancel(1, 0), 1, cfg, func(*ControlPacket, time.Duration) bool { return false })
+	if err != nil || answered {
+		t.Fatalf("Exchange returned %t, %v", answered, err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("Exchange returned after %v", d)
+	}
+}
+
+// failingTransport is a Transport whose Receive fails.
+type failingTransport struct{ err error }
+
+func (t failingTransport) Send(Message) error                       { return nil }
+func (t failingTransport) Receive(context.Context) (Message, error) { return nil, t.err }
+
+// This checks that Exchange reports a failing transport instead of treating it as
+// a silent receiver.
+func TestExchangeTransportError(t *testing.T) {
+	errBroken := errors.New("broken")
+	answered, err := Exchange(context.Background(), failingTransport{errBroken}, NewCancel(1, 0), 1, new(TransferConfig), func(*ControlPacket, time.Duration) bool { return true })
+	if err != errBroken || answered {
+		t.Fatalf("Exchange returned %t, %v", answered, err)
+	}
+}
+
+func TestProbeBitDepth(t *testing.T) {
+	// The receiver only supports up to 16 bits.
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if h, ok := msg.(*DumpHeader); ok {
+			if h.BitDepth > 16 {
+				r.Respond(NewNak(h.Channel, 0), 0)
+			} else {
+				r.Respond(NewAck(h.Channel, 0), 0)
+			}
+		}
+	})
+	h := &DumpHeader{Channel: 1, Number: 3, BitDepth: 24, Period: 22675}
+	for _, test := range []struct {
+		bits int
+		ok   bool
+	}{{24, false}, {16, true}} {
+		ok, err := ProbeBitDepth(context.Background(), r, h, test.bits, new(TransferConfig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok {
+			t.Errorf("%d bits: got %t, want %t", test.bits, ok, test.ok)
+		}
+	}
+	// The accepted probe must be cancelled.
+	last := r.Received()[len(r.Received())-1]
+	if cp, ok := last.(*ControlPacket); !ok || cp.Type != Cancel {
+		t.Fatalf("last message is %#v, want CANCEL", last)
+	}
+
+	// No response is reported as timeout.
+	silent := newMockReceiver(func(*mockReceiver, Message) {})
+	cfg := &TransferConfig{HandshakeTimeout: 10 * time.Millisecond}
+	if _, err := ProbeBitDepth(context.Background(), silent, h, 16, cfg); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want ErrTimeout", err)
+	}
+}
+
+func TestRunLoops(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, Number: 7, BitDepth: 16})
+	cfg := &TransferConfig{Loops: []LoopPoint{{Loop: 1, Type: LoopForward, Start: 10, End: 90}}}
+	if err := op.Run(context.Background(), r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	last := r.Received()[len(r.Received())-1]
+	want := &LoopPoint{Channel: 1, Number: 7, Loop: 1, Type: LoopForward, Start: 10, End: 90}
+	if lp, ok := last.(*LoopPoint); !ok || *lp != *want {
+		t.Fatalf("last message is %#v, want %#v", last, want)
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	// The receiver keeps the sender waiting forever.
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if h, ok := msg.(*DumpHeader); ok {
+			r.Respond(NewWait(h.Channel, 0), 0)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	err := op.Run(ctx, r, new(TransferConfig))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+	last := r.Received()[len(r.Received())-1]
+	if cp, ok := last.(*ControlPacket); !ok || cp.Type != Cancel {
+		t.Fatalf("last message is %#v, want CANCEL", last)
+	}
+}
+
+func TestRunHeaderWaitTimeout(t *testing.T) {
+	// The receiver sends WAIT, then nothing.
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if h, ok := msg.(*DumpHeader); ok {
+			r.Respond(NewWait(h.Channel, 0), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	start := time.Now()
+	err := op.Run(context.Background(), r, &TransferConfig{HeaderWaitTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Run returned after %v", d)
+	}
+	if len(r.Received()) != 1 {
+		t.Fatalf("receiver got %d messages, want only the header", len(r.Received()))
+	}
+}
+
+func TestRunHeaderWaitRepeated(t *testing.T) {
+	// The receiver keeps sending WAIT.
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		if h, ok := msg.(*DumpHeader); ok {
+			for i := 1; i <= 20; i++ {
+				r.Respond(NewWait(h.Channel, 0), time.Duration(i)*10*time.Millisecond)
+			}
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	start := time.Now()
+	err := op.Run(context.Background(), r, &TransferConfig{HeaderWaitTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("Run returned after %v", d)
+	}
+}
+
+func TestRunProbeNonHandshaking(t *testing.T) {
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	cfg := &TransferConfig{
+		Probe:              true,
+		HandshakeTimeout:   20 * time.Millisecond,
+		HeaderRetries:      2,
+		HeaderRetryTimeout: time.Second,
+		PacketDelay:        time.Millisecond,
+	}
+	start := time.Now()
+	if err := op.Run(context.Background(), r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Run returned after %v", d)
+	}
+	msgs := r.Received()
+	if len(msgs) < 3 {
+		t.Fatalf("receiver got %d messages", len(msgs))
+	}
+	if _, ok := msgs[0].(*DumpRequest); !ok {
+		t.Fatalf("first message is %#v, want DumpRequest", msgs[0])
+	}
+	if _, ok := msgs[1].(*DumpHeader); !ok {
+		t.Fatalf("second message is %#v, want DumpHeader", msgs[1])
+	}
+	if _, ok := msgs[2].(*DataPacket); !ok {
+		t.Fatalf("third message is %#v, want DataPacket", msgs[2])
+	}
+}
+
+func TestRunFirstPacketDelay(t *testing.T) {
+	var (
+		ackTime   time.Time
+		firstTime time.Time
+	)
+	r := newMockReceiver(func(r *mockReceiver, msg Message) {
+		switch msg := msg.(type) {
+		case *DumpHeader:
+			ackTime = time.Now()
+			r.Respond(NewAck(msg.Channel, 0), 0)
+		case *DataPacket:
+			if firstTime.IsZero() {
+				firstTime = time.Now()
+			}
+			r.Respond(NewAck(msg.Channel, msg.PacketNumber), 0)
+		}
+	})
+	op := NewSendOp(testWaveform(100), &DumpHeader{Channel: 1, BitDepth: 16})
+	cfg := &TransferConfig{FirstPacketDelay: 30 * time.Millisecond}
+	if err := op.Run(context.Background(), r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := firstTime.Sub(ackTime); d < cfg.FirstPacketDelay {
+		t.Fatalf("first packet sent %v after header ACK", d)
+	}
+}
+
+func TestNewTransferConfig(t *testing.T) {
+	cfg := NewTransferConfig()
+	if cfg.PacketDelay != 20*time.Millisecond || cfg.NakRetries != 3 || cfg.HandshakeTimeout != 2*time.Second {
+		t.Fatalf("wrong defaults %+v", cfg)
+	}
+	// Explicit settings are kept.
+	c := (&TransferConfig{AckTimeout: time.Second, NakRetries: NoRetries}).withDefaults()
+	if c.AckTimeout != time.Second || c.NakRetries != NoRetries || c.ConfirmTimeout != 2*time.Second {
+		t.Fatalf("wrong config %+v", c)
+	}
+}
@@ -0,0 +1,40 @@
+package sds
+
+// Stats contains statistics of waveform data.
+type Stats struct {
+	Min, Max int
+	Mean     float64 // average sample value, i.e. the DC offset
+
+	// Number of samples at positive and negative full scale. A large count
+	// indicates clipping.
+	FullScalePos int
+	FullScaleNeg int
+}
+
+// ComputeStats computes statistics of signed samples with the given bit depth.
+func ComputeStats(samples []int, bitDepth int) Stats {
+	var (
+		st        Stats
+		sum       float64
+		low, high = FullScale(bitDepth)
+	)
+	for i, s := range samples {
+		if i == 0 || s < st.Min {
+			st.Min = s
+		}
+		if i == 0 || s > st.Max {
+			st.Max = s
+		}
+		if s >= high {
+			st.FullScalePos++
+		}
+		if s <= low {
+			st.FullScaleNeg++
+		}
+		sum += float64(s)
+	}
+	if len(samples) > 0 {
+		st.Mean = sum / float64(len(samples))
+	}
+	return st
+}
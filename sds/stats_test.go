@@ -0,0 +1,14 @@
+package sds
+
+import "testing"
+
+func TestComputeStats(t *testing.T) {
+	st := ComputeStats([]int{-128, -128, 0, 10, 127, 127, 127}, 8)
+	want := Stats{Min: -128, Max: 127, Mean: 135.0 / 7, FullScalePos: 3, FullScaleNeg: 2}
+	if st != want {
+		t.Fatalf("got %+v, want %+v", st, want)
+	}
+	if st := ComputeStats(nil, 16); st != (Stats{}) {
+		t.Fatalf("empty waveform has stats %+v", st)
+	}
+}
@@ -0,0 +1,94 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// StreamTransport carries SDS messages over a byte stream, such as a network
+// connection or a pipe. Messages are written in their sysex encoding. Incoming
+// messages are framed in the same way as by Decoder. Messages that can't be decoded
+// are skipped.
+type StreamTransport struct {
+	rw io.ReadWriter
+
+	sendMu  sync.Mutex
+	sendBuf []byte
+
+	msgs    chan Message
+	readErr error // set before msgs is closed
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+var _ Transport = (*StreamTransport)(nil)
+
+var errStreamClosed = errors.New("stream transport closed")
+
+// NewStreamTransport creates a transport on rw. It starts reading from rw
+// immediately.
+func NewStreamTransport(rw io.ReadWriter) *StreamTransport {
+	t := &StreamTransport{rw: rw, msgs: make(chan Message, 64), done: make(chan struct{})}
+	go t.readLoop()
+	return t
+}
+
+func (t *StreamTransport) readLoop() {
+	defer close(t.msgs)
+	dec := NewDecoder(t.rw)
+	for {
+		frame, err := dec.readFrame()
+		if err != nil {
+			t.readErr = err
+			return
+		}
+		if msg, err := Decode(frame); err == nil {
+			select {
+			case t.msgs <- msg:
+			case <-t.done:
+				return
+			}
+		}
+	}
+}
+
+// Send writes a message to the stream.
+func (t *StreamTransport) Send(msg Message) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.sendBuf = msg.Encode(t.sendBuf[:0])
+	_, err := t.rw.Write(t.sendBuf)
+	return err
+}
+
+// Receive waits for the next message. When reading from the stream has failed, it
+// returns the read error, e.g. io.EOF.
+func (t *StreamTransport) Receive(ctx context.Context) (Message, error) {
+	select {
+	case msg, ok := <-t.msgs:
+		if !ok {
+			if t.readErr == nil {
+				return nil, errStreamClosed
+			}
+			return nil, t.readErr
+		}
+		return msg, nil
+	case <-t.done:
+		return nil, errStreamClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops reading and closes the underlying stream if it implements io.Closer.
+// Messages that haven't been received yet are discarded.
+func (t *StreamTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	if c, ok := t.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package sds
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamTransport(t *testing.T) {
+	c1, c2 := net.Pipe()
+	sender, receiver := NewStreamTransport(c1), NewStreamTransport(c2)
+	defer sender.Close()
+	defer receiver.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	samples := testWaveform(500)
+	errc := make(chan error, 1)
+	go func() {
+		op := NewSendOp(samples, &DumpHeader{Channel: 3, Number: 9, BitDepth: 16, Period: 22675})
+		errc <- op.Run(ctx, sender, new(TransferConfig))
+	}()
+
+	cfg := &TransferConfig{Channel: 3}
+	h, received, err := ReceiveDump(ctx, receiver, cfg)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal("send error:", err)
+	}
+	if h.Number != 9 || !samplesEqual(received, samples) {
+		t.Fatal("wrong waveform received")
+	}
+
+	// Receive returns the read error after the stream is closed.
+	c1.Close()
+	if _, err := receiver.Receive(ctx); err != io.EOF {
+		t.Fatalf("got error %v after close, want io.EOF", err)
+	}
+}
+
+// This checks that Close stops the read loop even when nobody receives the
+// buffered messages.
+func TestStreamTransportCloseUnread(t *testing.T) {
+	var stream bytes.Buffer
+	for i := 0; i < 100; i++ {
+		stream.Write(NewAck(1, byte(i)).Encode(nil))
+	}
+	// After the messages, reading blocks like on an idle connection.
+	idle, _ := io.Pipe()
+	tr := NewStreamTransport(struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(&stream, idle), io.Discard})
+	time.Sleep(20 * time.Millisecond)
+	tr.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for range tr.msgs {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("read loop still running after Close")
+	}
+	if _, err := tr.Receive(context.Background()); err == nil {
+		t.Fatal("no error from Receive after Close")
+	}
+}
@@ -1,50 +1,274 @@
 package sds
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"sync"
+)
 
 // SendOp handles the creation of messages to transfer a waveform.
+//
+// The methods of SendOp must not be called concurrently, with the exception of
+// Status, Done, Progress and Confirmed. These can be used to observe a transfer
+// performed by Run in another goroutine.
 type SendOp struct {
+	header   *DumpHeader
 	length   int
 	bitDepth int
-	samples  []int
-	data     DataPacket
-	num      byte
+	channel  byte
+	all      []int         // waveform, nil for streaming operations
+	packets  []*DataPacket // stored packets, see NewPacketSendOp
+
+	// for streaming operations
+	next func(n int) ([]int, bool)
+	buf  []int
+	eof  bool // sample source is exhausted
+
+	mu        sync.Mutex // protects the fields below
+	pos       int        // number of samples sent
+	num       byte
+	waiting   bool // receiver sent WAIT
+	confirmed bool
+}
+
+// TransferStatus is a snapshot of the state of a SendOp.
+type TransferStatus struct {
+	Sent     int  // number of data packets sent
+	Total    int  // total number of data packets
+	Progress int  // percentage of completion
+	Waiting  bool // the receiver has paused the transfer with WAIT
+	Done     bool // all packets have been sent
 }
 
+// NewSendOp creates a send operation for the given waveform. It sets the Length of h
+// to the number of samples.
 func NewSendOp(samples []int, h *DumpHeader) *SendOp {
 	h.Length = uint(len(samples))
 
 	s := &SendOp{
+		header:   h,
 		length:   len(samples),
 		bitDepth: int(h.BitDepth),
-		samples:  samples,
+		channel:  h.Channel,
+		all:      samples,
+	}
+	return s
+}
+
+// NewStreamSendOp creates a send operation which pulls the waveform from a sample
+// source instead of holding it in memory. This is useful for very long or generated
+// waveforms. The Length of h is set to length.
+//
+// The next function is called with the number of samples needed for the next packet
+// and should return at most that many samples. When it returns false, the source is
+// considered exhausted and the remainder of the waveform up to length is sent as zero
+// samples. Streaming operations do not support Seek.
+func NewStreamSendOp(length int, h *DumpHeader, next func(n int) ([]int, bool)) *SendOp {
+	h.Length = uint(length)
+
+	s := &SendOp{
+		header:   h,
+		length:   length,
+		bitDepth: int(h.BitDepth),
+		channel:  h.Channel,
+		next:     next,
 	}
-	s.data.Channel = h.Channel
 	return s
 }
 
+// NewPacketSendOp creates a send operation which transmits the given data packets
+// instead of encoding a waveform, e.g. the packets of a captured dump. The packets
+// are sent unchanged, packets with a bad checksum included. Their number must match
+// the Length of h.
+func NewPacketSendOp(h *DumpHeader, packets []*DataPacket) (*SendOp, error) {
+	if want := ExpectedPackets(h); len(packets) != want {
+		return nil, fmt.Errorf("dump has %d packets, header announces %d", len(packets), want)
+	}
+	s := &SendOp{
+		header:   h,
+		length:   int(h.Length),
+		bitDepth: int(h.BitDepth),
+		channel:  h.Channel,
+		packets:  packets,
+	}
+	return s, nil
+}
+
+// SplitWaveform splits samples into parts of at most MaxLength samples. This can
+// be used to transfer a waveform that is too long for a single dump into
+// consecutive waveform slots.
+func SplitWaveform(samples []int) [][]int {
+	var parts [][]int
+	for len(samples) > MaxLength {
+		parts = append(parts, samples[:MaxLength])
+		samples = samples[MaxLength:]
+	}
+	return append(parts, samples)
+}
+
+// MergeWaveforms joins the parts of a waveform that was split across consecutive
+// slots, e.g. by SplitWaveform. headers and samples hold the dumps of the parts in
+// order. All parts must have the same bit depth and sample period. The returned
+// header is a copy of the first header with the total length, so it keeps the loop
+// of the first part. Note that the total length may exceed MaxLength.
+func MergeWaveforms(headers []*DumpHeader, samples [][]int) (*DumpHeader, []int, error) {
+	if len(headers) == 0 {
+		return nil, nil, fmt.Errorf("no waveforms to merge")
+	}
+	if len(headers) != len(samples) {
+		return nil, nil, fmt.Errorf("have %d headers, but %d sample slices", len(headers), len(samples))
+	}
+	first := headers[0]
+	total := 0
+	for i, h := range headers {
+		if h.BitDepth != first.BitDepth {
+			return nil, nil, fmt.Errorf("part %d has %d bits, first part has %d", i, h.BitDepth, first.BitDepth)
+		}
+		if h.Period != first.Period {
+			return nil, nil, fmt.Errorf("part %d has sample period %dns, first part has %dns", i, h.Period, first.Period)
+		}
+		total += len(samples[i])
+	}
+	merged := make([]int, 0, total)
+	for _, s := range samples {
+		merged = append(merged, s...)
+	}
+	h := first.Clone()
+	h.Length = uint(total)
+	return h, merged, nil
+}
+
 // Done returns true when the complete waveform has been sent.
 func (s *SendOp) Done() bool {
-	return len(s.samples) == 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pos >= s.length
 }
 
-// Progress returns the percentage of completion.
+// Progress returns the percentage of completion. It is 100 for an empty waveform.
 func (s *SendOp) Progress() int {
-	done := s.length - len(s.samples)
-	return int(math.Round((float64(done) / float64(s.length)) * 100))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress()
+}
+
+// Status returns the current state of the operation. It is safe to call Status while
+// the transfer runs in another goroutine.
+func (s *SendOp) Status() TransferStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return TransferStatus{
+		Sent:     s.packetsSent(),
+		Total:    ExpectedPackets(s.header),
+		Progress: s.progress(),
+		Waiting:  s.waiting,
+		Done:     s.pos >= s.length,
+	}
+}
+
+func (s *SendOp) progress() int {
+	if s.length == 0 {
+		return 100
+	}
+	return int(math.Round((float64(s.pos) / float64(s.length)) * 100))
+}
+
+// packetsSent returns the number of data packets created so far.
+func (s *SendOp) packetsSent() int {
+	count := new(DataPacket).SampleCount(s.bitDepth)
+	return (s.pos + count - 1) / count
+}
+
+func (s *SendOp) setWaiting(w bool) {
+	s.mu.Lock()
+	s.waiting = w
+	s.mu.Unlock()
+}
+
+// Seek positions the operation so that the next message is the packet at the given
+// index, counting from zero. This can be used to resume an interrupted transfer.
+func (s *SendOp) Seek(packet int) error {
+	if s.next != nil {
+		return fmt.Errorf("can't seek in streaming operation")
+	}
+	offset := packet * new(DataPacket).SampleCount(s.bitDepth)
+	if packet < 0 || offset >= s.length {
+		return fmt.Errorf("packet %d out of range", packet)
+	}
+	s.mu.Lock()
+	s.pos = offset
+	s.num = byte(packet % 128)
+	s.mu.Unlock()
+	return nil
 }
 
-// NextMessage returns the next message to be sent.
+// NextMessage returns the next message to be sent. Every call returns a new packet,
+// so it is safe to keep the returned message.
 func (s *SendOp) NextMessage() Message {
 	if s.Done() {
 		return nil
 	}
 
-	// Prepare next data packet.
-	s.samples = s.data.SetSamples(s.samples, int(s.bitDepth))
-	s.data.PacketNumber = s.nextNumber()
-	s.data.Checksum = s.data.ComputeChecksum()
-	return &s.data
+	// Prepare next data packet. Only NextMessage modifies pos, so it can be read
+	// without holding the lock here.
+	p := &DataPacket{Channel: s.channel}
+	n := p.SampleCount(s.bitDepth)
+	if rem := s.length - s.pos; n > rem {
+		n = rem
+	}
+	stored := s.packets != nil
+	switch {
+	case stored:
+		*p = *s.packets[s.packetsSent()]
+	case s.next == nil:
+		p.SetSamples(s.all[s.pos:s.pos+n], s.bitDepth)
+	default:
+		s.pullSamples(p, n)
+	}
+	s.mu.Lock()
+	s.pos += n
+	num := s.nextNumber()
+	s.mu.Unlock()
+	if !stored {
+		p.PacketNumber = num
+		p.Checksum = p.ComputeChecksum()
+	}
+	return p
+}
+
+// pullSamples fills p with n samples from the sample source. The source is called
+// until it has supplied n samples or is exhausted.
+func (s *SendOp) pullSamples(p *DataPacket, n int) {
+	s.buf = s.buf[:0]
+	for len(s.buf) < n && !s.eof {
+		chunk, ok := s.next(n - len(s.buf))
+		if len(chunk) > n-len(s.buf) {
+			chunk = chunk[:n-len(s.buf)]
+		}
+		s.buf = append(s.buf, chunk...)
+		if !ok {
+			s.eof = true
+		}
+	}
+	for len(s.buf) < n {
+		s.buf = append(s.buf, 0)
+	}
+	p.SetSamples(s.buf, s.bitDepth)
+}
+
+// AllMessages returns all remaining messages of the transfer. When the operation
+// is positioned at the start of the waveform, the list begins with the DumpHeader.
+// Like NextMessage, each packet is a distinct value. The operation is Done after
+// the call.
+func (s *SendOp) AllMessages() []Message {
+	var msgs []Message
+	if s.pos == 0 {
+		msgs = append(msgs, s.header)
+	}
+	for !s.Done() {
+		msgs = append(msgs, s.NextMessage())
+	}
+	return msgs
 }
 
 func (s *SendOp) nextNumber() byte {
@@ -56,3 +280,72 @@ func (s *SendOp) nextNumber() byte {
 	}
 	return n
 }
+
+// ReceiveOp handles the reassembly of a waveform from received DataPackets.
+type ReceiveOp struct {
+	length   int
+	bitDepth int
+	channel  byte
+	samples  []int
+	next     byte // number of the next expected packet
+}
+
+// NewReceiveOp creates a receive operation for the waveform announced by h. The header
+// is not checked, use Validate for that. The sample buffer is allocated for at most
+// MaxLength samples regardless of the header.
+func NewReceiveOp(h *DumpHeader) *ReceiveOp {
+	capacity := h.Length
+	if capacity > MaxLength {
+		capacity = MaxLength
+	}
+	return &ReceiveOp{
+		length:   int(h.Length),
+		bitDepth: int(h.BitDepth),
+		channel:  h.Channel,
+		samples:  make([]int, 0, capacity),
+	}
+}
+
+// Done returns true when the complete waveform has been received.
+func (r *ReceiveOp) Done() bool {
+	return len(r.samples) >= r.length
+}
+
+// Progress returns the percentage of completion. It is 100 for an empty waveform.
+func (r *ReceiveOp) Progress() int {
+	if r.length == 0 {
+		return 100
+	}
+	return int(math.Round((float64(len(r.samples)) / float64(r.length)) * 100))
+}
+
+// Samples returns the waveform data received so far. The padding of the final packet
+// is not included, i.e. the result never has more than Length samples.
+func (r *ReceiveOp) Samples() []int {
+	return r.samples
+}
+
+// HandlePacket processes a received packet and returns the response that should be
+// sent to the transmitter.
+//
+// Packets with a bad checksum, or data bytes with the high bit set, are rejected with
+// NAK so the transmitter resends them. A retransmission of the
+// previously accepted packet (which happens when the transmitter didn't get the ACK)
+// is acknowledged again, but its data is not added. Any other unexpected packet
+// number is answered with a NAK for the expected packet. Since packet numbers wrap
+// from 127 to 0, packets are recognized by their position in sequence rather than
+// by comparing numbers.
+func (r *ReceiveOp) HandlePacket(p *DataPacket) *ControlPacket {
+	switch {
+	case !p.Valid7Bit() || p.ComputeChecksum() != p.Checksum:
+		return NewNak(r.channel, p.PacketNumber)
+	case p.PacketNumber == r.next && !r.Done():
+		r.samples = p.GetSamplesN(r.samples, r.bitDepth, r.length-len(r.samples))
+		r.next = (r.next + 1) & 0x7F
+		return NewAck(r.channel, p.PacketNumber)
+	case p.PacketNumber == (r.next-1)&0x7F && len(r.samples) > 0:
+		return NewAck(r.channel, p.PacketNumber)
+	default:
+		return NewNak(r.channel, r.next)
+	}
+}
@@ -0,0 +1,290 @@
+package sds
+
+import "testing"
+
+func TestSendOpNextMessageFresh(t *testing.T) {
+	samples := make([]int, 80)
+	for i := range samples {
+		samples[i] = i
+	}
+	op := NewSendOp(samples, &DumpHeader{BitDepth: 16})
+	m1 := op.NextMessage()
+	first := *m1.(*DataPacket)
+	m2 := op.NextMessage()
+	if m1 == m2 {
+		t.Fatal("NextMessage returned the same packet twice")
+	}
+	if *m1.(*DataPacket) != first {
+		t.Fatal("first packet modified by second NextMessage call")
+	}
+	if m1.(*DataPacket).PacketNumber != 0 || m2.(*DataPacket).PacketNumber != 1 {
+		t.Fatal("wrong packet numbers")
+	}
+}
+
+func TestPacketNumberWrapAround(t *testing.T) {
+	// 20000 16-bit samples need 500 packets, wrapping the packet number three times.
+	samples := make([]int, 20000)
+	for i := range samples {
+		samples[i] = (i * 37 % 65536) - 32768
+	}
+	h := &DumpHeader{Channel: 3, BitDepth: 16}
+	send := NewSendOp(samples, h)
+	recv := NewReceiveOp(h)
+
+	var count int
+	for !send.Done() {
+		p := send.NextMessage().(*DataPacket)
+		if p.PacketNumber != byte(count%128) {
+			t.Fatalf("packet %d has number %d", count, p.PacketNumber)
+		}
+		resp := recv.HandlePacket(p)
+		if resp.Type != Ack || resp.PacketNumber != p.PacketNumber || resp.Channel != 3 {
+			t.Fatalf("packet %d: wrong response %+v", count, resp)
+		}
+		count++
+	}
+	if count != 500 {
+		t.Fatalf("sent %d packets, want 500", count)
+	}
+	if !recv.Done() {
+		t.Fatal("receive not done")
+	}
+	if !samplesEqual(recv.Samples(), samples) {
+		t.Fatal("received samples not equal")
+	}
+}
+
+func TestReceiveOpDuplicatePacket(t *testing.T) {
+	samples := make([]int, 200)
+	for i := range samples {
+		samples[i] = i
+	}
+	h := &DumpHeader{BitDepth: 16}
+	send := NewSendOp(samples, h)
+	recv := NewReceiveOp(h)
+
+	p0 := send.NextMessage().(*DataPacket)
+	p1 := send.NextMessage().(*DataPacket)
+	if resp := recv.HandlePacket(p0); resp.Type != Ack {
+		t.Fatalf("wrong response to first packet %+v", resp)
+	}
+	// Retransmission of packet 0 is acknowledged but ignored.
+	if resp := recv.HandlePacket(p0); resp.Type != Ack || resp.PacketNumber != 0 {
+		t.Fatalf("wrong response to duplicate %+v", resp)
+	}
+	// Skipping a packet is rejected.
+	p2 := send.NextMessage().(*DataPacket)
+	if resp := recv.HandlePacket(p2); resp.Type != Nak || resp.PacketNumber != 1 {
+		t.Fatalf("wrong response to out-of-order packet %+v", resp)
+	}
+	// Corrupt packet is rejected.
+	bad := p1.Clone()
+	bad.Checksum ^= 1
+	if resp := recv.HandlePacket(bad); resp.Type != Nak || resp.PacketNumber != 1 {
+		t.Fatalf("wrong response to corrupt packet %+v", resp)
+	}
+	recv.HandlePacket(p1)
+	recv.HandlePacket(p2)
+	for !send.Done() {
+		recv.HandlePacket(send.NextMessage().(*DataPacket))
+	}
+	if !samplesEqual(recv.Samples(), samples) {
+		t.Fatal("received samples not equal")
+	}
+}
+
+func TestSplitWaveform(t *testing.T) {
+	samples := make([]int, 2*MaxLength+10)
+	parts := SplitWaveform(samples)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts, want 3", len(parts))
+	}
+	if len(parts[0]) != MaxLength || len(parts[1]) != MaxLength || len(parts[2]) != 10 {
+		t.Fatalf("wrong part lengths %d, %d, %d", len(parts[0]), len(parts[1]), len(parts[2]))
+	}
+	if parts := SplitWaveform(samples[:100]); len(parts) != 1 || len(parts[0]) != 100 {
+		t.Fatal("short waveform was split")
+	}
+}
+
+func TestMergeWaveforms(t *testing.T) {
+	samples := testWaveform(MaxLength + 100)
+	parts := SplitWaveform(samples)
+	h0 := &DumpHeader{Number: 1, BitDepth: 16, Period: 22675, LoopStart: 10, LoopEnd: 20, Length: uint(len(parts[0]))}
+	h1 := &DumpHeader{Number: 2, BitDepth: 16, Period: 22675, LoopType: LoopNone, Length: uint(len(parts[1]))}
+	h, merged, err := MergeWaveforms([]*DumpHeader{h0, h1}, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samplesEqual(merged, samples) {
+		t.Fatal("merged samples differ")
+	}
+	want := *h0
+	want.Length = uint(len(samples))
+	if *h != want {
+		t.Fatalf("wrong header %+v", *h)
+	}
+
+	// Parts must match.
+	h1.BitDepth = 24
+	if _, _, err := MergeWaveforms([]*DumpHeader{h0, h1}, parts); err == nil {
+		t.Fatal("no error for different bit depths")
+	}
+	h1.BitDepth, h1.Period = 16, 20000
+	if _, _, err := MergeWaveforms([]*DumpHeader{h0, h1}, parts); err == nil {
+		t.Fatal("no error for different sample periods")
+	}
+}
+
+func TestSendOpSeek(t *testing.T) {
+	samples := make([]int, 10000)
+	for i := range samples {
+		samples[i] = i
+	}
+	op := NewSendOp(samples, &DumpHeader{BitDepth: 16})
+	if err := op.Seek(130); err != nil {
+		t.Fatal(err)
+	}
+	p := op.NextMessage().(*DataPacket)
+	if p.PacketNumber != 2 {
+		t.Fatalf("wrong packet number %d, want 2", p.PacketNumber)
+	}
+	if got := p.GetSamples(nil, 16); !samplesEqual(got, samples[130*40:131*40]) {
+		t.Fatalf("wrong samples %d", got)
+	}
+	if err := op.Seek(250); err == nil {
+		t.Fatal("no error for seek beyond end")
+	}
+}
+
+func TestReceiveOpTrimsPadding(t *testing.T) {
+	samples := []int{1, 2, 3, 4, 5}
+	h := &DumpHeader{BitDepth: 16}
+	send := NewSendOp(samples, h)
+	recv := NewReceiveOp(h)
+	recv.HandlePacket(send.NextMessage().(*DataPacket))
+	if !recv.Done() {
+		t.Fatal("receive not done")
+	}
+	if got := recv.Samples(); !samplesEqual(got, samples) {
+		t.Fatalf("wrong samples %d", got)
+	}
+	if p := recv.Progress(); p != 100 {
+		t.Fatalf("wrong progress %d%%", p)
+	}
+}
+
+func TestSendOpAllMessages(t *testing.T) {
+	h := &DumpHeader{BitDepth: 16}
+	msgs := NewSendOp(make([]int, 130), h).AllMessages()
+	if len(msgs) != 5 {
+		t.Fatalf("got %d messages, want 5", len(msgs))
+	}
+	if msgs[0] != h {
+		t.Fatal("first message is not the header")
+	}
+	for i, msg := range msgs[1:] {
+		if p := msg.(*DataPacket); p.PacketNumber != byte(i) {
+			t.Fatalf("message %d has packet number %d", i+1, p.PacketNumber)
+		}
+	}
+
+	// After Seek, the header is not included.
+	op := NewSendOp(make([]int, 130), h)
+	if err := op.Seek(1); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := op.AllMessages(); len(msgs) != 3 {
+		t.Fatalf("got %d messages after Seek, want 3", len(msgs))
+	}
+}
+
+func TestStreamSendOp(t *testing.T) {
+	samples := make([]int, 1000)
+	for i := range samples {
+		samples[i] = (i * 37 % 65536) - 32768
+	}
+	// The source supplies at most 7 samples per call.
+	var pos int
+	source := func(n int) ([]int, bool) {
+		if n > 7 {
+			n = 7
+		}
+		if pos+n > len(samples) {
+			n = len(samples) - pos
+		}
+		chunk := samples[pos : pos+n]
+		pos += n
+		return chunk, pos < len(samples)
+	}
+	h := &DumpHeader{BitDepth: 16}
+	send := NewStreamSendOp(len(samples), h, source)
+	if h.Length != 1000 {
+		t.Fatalf("wrong header length %d", h.Length)
+	}
+	recv := NewReceiveOp(h)
+	for !send.Done() {
+		recv.HandlePacket(send.NextMessage().(*DataPacket))
+	}
+	if !recv.Done() {
+		t.Fatal("receive not done")
+	}
+	if !samplesEqual(recv.Samples(), samples) {
+		t.Fatal("received samples not equal")
+	}
+	if err := send.Seek(0); err == nil {
+		t.Fatal("no error for Seek on streaming operation")
+	}
+}
+
+func TestStreamSendOpExhausted(t *testing.T) {
+	source := func(n int) ([]int, bool) {
+		return []int{1, 2, 3}, false
+	}
+	h := &DumpHeader{BitDepth: 16}
+	msgs := NewStreamSendOp(100, h, source).AllMessages()
+	if len(msgs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(msgs))
+	}
+	recv := NewReceiveOp(h)
+	for _, msg := range msgs[1:] {
+		recv.HandlePacket(msg.(*DataPacket))
+	}
+	want := make([]int, 100)
+	copy(want, []int{1, 2, 3})
+	if got := recv.Samples(); !samplesEqual(got, want) {
+		t.Fatalf("wrong samples %d", got)
+	}
+}
+
+func TestPacketSendOp(t *testing.T) {
+	h := &DumpHeader{Channel: 1, BitDepth: 16}
+	orig := NewSendOp(testWaveform(100), h).AllMessages()[1:]
+	packets := make([]*DataPacket, len(orig))
+	for i, m := range orig {
+		packets[i] = m.(*DataPacket)
+	}
+	packets[1].Checksum ^= 1 // bad packets are sent as they are
+
+	op, err := NewPacketSendOp(h, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := op.AllMessages()
+	if len(sent) != 4 || sent[0] != h {
+		t.Fatalf("wrong messages %v", sent)
+	}
+	for i, m := range sent[1:] {
+		if *m.(*DataPacket) != *packets[i] {
+			t.Errorf("packet %d modified", i)
+		}
+	}
+	if st := op.Status(); !st.Done || st.Sent != 3 {
+		t.Errorf("wrong status %+v", st)
+	}
+
+	if _, err := NewPacketSendOp(h, packets[:2]); err == nil {
+		t.Error("no error for missing packet")
+	}
+}
@@ -0,0 +1,13 @@
+package sds
+
+import "context"
+
+// Transport is a connection carrying SDS messages.
+type Transport interface {
+	// Send transmits a message.
+	Send(msg Message) error
+
+	// Receive waits for the next message. When ctx is done before a message
+	// arrives, it returns the context error.
+	Receive(ctx context.Context) (Message, error)
+}